@@ -0,0 +1,738 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nathaniel28/acrawl/omnihash"
+)
+
+// subcommands, selected by the first argument; anything else is taken as a
+// list of collections to crawl
+var commands = map[string]func(args []string) error{
+	"stats":      statsCmd,
+	"duplicates": duplicatesCmd,
+	"query":      queryCmd,
+	"dump":       dumpCmd,
+	"add":        addCmd,
+	"requeue":    requeueCmd,
+	"match":      matchCmd,
+	"intersect":  intersectCmd,
+	"merge":      mergeCmd,
+	"delete":     deleteCmd,
+	"vacuum":     vacuumCmd,
+	"explain":    explainCmd,
+	"list":       listCmd,
+	"show":       showCmd,
+	"repair":     repairCmd,
+	"members":    membersCmd,
+	"reparse":    reparseCmd,
+	"check":      checkCmd,
+	"item":       itemCmd,
+	"histogram":  histogramCmd,
+	"watch":      watchCmd,
+}
+
+func statsCmd(args []string) error {
+	storage, err := omnihash.NewReadOnlyStorage(hashesDB)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	st, err := storage.Stats()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("items:           %d\n", st.Items)
+	fmt.Printf("files:           %d\n", st.Files)
+	fmt.Printf("hashes:          %d\n", st.Hashes)
+	fmt.Printf("distinct hashes: %d\n", st.DistinctHashes)
+	fmt.Printf("files per item:  %.2f\n", st.FilesPerItem)
+	fmt.Printf("database size:   %d bytes\n", st.Size)
+	return nil
+}
+
+func listCmd(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	hashes := fs.Bool("hashes", false, "also count each collection's hashes, which reads the whole index")
+	parseFlags(fs, args)
+
+	storage, err := omnihash.NewReadOnlyStorage(hashesDB)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	counts, err := storage.Collections(*hashes)
+	if err != nil {
+		return err
+	}
+	for _, c := range counts {
+		name := c.Collection
+		if name == "" {
+			name = "(unknown)"
+		}
+		if *hashes {
+			fmt.Printf("%d %d %s\n", c.Items, c.Hashes, name)
+		} else {
+			fmt.Printf("%d %s\n", c.Items, name)
+		}
+	}
+	return nil
+}
+
+// membersCmd prints the stored items that belong to a collection, however
+// they were found.
+func membersCmd(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: members collection")
+	}
+	storage, err := omnihash.NewReadOnlyStorage(hashesDB)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	names, err := storage.Members(args[0])
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+// repairCmd removes what older versions stored but wouldn't be now, listing
+// the items left with nothing so they can be fetched again.
+func repairCmd(args []string) error {
+	storage, err := omnihash.NewStorage(hashesDB, omnihash.StorageOptions{})
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	st, err := storage.Repair(func(item string) {
+		fmt.Println(item)
+	})
+	log.Printf("removed %d malformed or skipped hashes, %d files, and %d items left empty\n", st.Hashes, st.Files, st.Items)
+	return err
+}
+
+// reparseCmd fills in columns added since items were stored, from the
+// listings kept with -keep-listings.
+func reparseCmd(args []string) error {
+	storage, err := omnihash.NewStorage(hashesDB, omnihash.StorageOptions{})
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	st, err := storage.Reparse()
+	log.Printf("reparsed %d stored listings, filling in %d files\n", st.Items, st.Files)
+	return err
+}
+
+// checkCmd looks for corruption and dangling rows in hashes.db, failing if
+// it finds any.
+func checkCmd(args []string) error {
+	storage, err := omnihash.NewReadOnlyStorage(hashesDB)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	reports, err := storage.Check()
+	if err != nil {
+		return err
+	}
+	bad := 0
+	for _, r := range reports {
+		fmt.Printf("%s:\n", r.Path)
+		tables := make([]string, 0, len(r.Rows))
+		for table := range r.Rows {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		for _, table := range tables {
+			fmt.Printf("  %-17s %d rows\n", table, r.Rows[table])
+		}
+		for _, msg := range r.Integrity {
+			fmt.Printf("  corrupt: %s\n", msg)
+		}
+		for _, what := range r.Missing {
+			fmt.Printf("  missing: %s\n", what)
+		}
+		for table, n := range r.Orphans {
+			fmt.Printf("  orphaned: %d rows of %s\n", n, table)
+		}
+		if !r.OK() {
+			bad++
+		}
+	}
+	if bad > 0 {
+		return fmt.Errorf("found problems in %d of %d databases", bad, len(reports))
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+// showCmd prints the stored files of an item and their hashes.
+func showCmd(args []string) error {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the files as a JSON array")
+	var enc omnihash.HashEncoding
+	fs.TextVar(&enc, "encoding", omnihash.Hex, "write hashes in hex, upper-hex, base32, or base64")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: show [-json] item")
+	}
+	item := fs.Arg(0)
+
+	storage, err := omnihash.NewReadOnlyStorage(hashesDB)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	files, err := storage.FilesForItem(item)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("%s isn't stored", item)
+	}
+	if *asJSON {
+		type jsonFile struct {
+			Name   string            `json:"name"`
+			Format string            `json:"format,omitempty"`
+			Hashes map[string]string `json:"hashes"`
+		}
+		out := make([]jsonFile, len(files))
+		for i, f := range files {
+			out[i] = jsonFile{Name: f.Name, Format: f.Format, Hashes: make(map[string]string)}
+			for algo, hash := range f.Hashes {
+				out[i].Hashes[algo] = enc.Encode(hash)
+			}
+		}
+		jsonEnc := json.NewEncoder(os.Stdout)
+		jsonEnc.SetIndent("", "  ")
+		return jsonEnc.Encode(out)
+	}
+	for _, f := range files {
+		algos := make([]string, 0, len(f.Hashes))
+		for algo := range f.Hashes {
+			algos = append(algos, algo)
+		}
+		sort.Strings(algos)
+		for _, algo := range algos {
+			fmt.Printf("%-6s %s %s\n", algo, enc.Encode(f.Hashes[algo]), f.Name)
+		}
+	}
+	return nil
+}
+
+func duplicatesCmd(args []string) error {
+	fs := flag.NewFlagSet("duplicates", flag.ExitOnError)
+	minItems := fs.Int("min", 1, "only report hashes found in more than this many items")
+	algo := fs.String("algo", "sha1", "hash algorithm to compare files by")
+	var enc omnihash.HashEncoding
+	fs.TextVar(&enc, "encoding", omnihash.Hex, "write hashes in hex, upper-hex, base32, or base64")
+	parseFlags(fs, args)
+
+	storage, err := omnihash.NewReadOnlyStorage(hashesDB)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	return storage.Duplicates(*algo, *minItems, func(hash []byte, items []string) error {
+		fmt.Printf("%s %d %s\n", enc.Encode(hash), len(items), strings.Join(items, " "))
+		return nil
+	})
+}
+
+// histogramCmd prints one of a few distributions over the stored hashes, a
+// row at a time.
+func histogramCmd(args []string) error {
+	fs := flag.NewFlagSet("histogram", flag.ExitOnError)
+	of := fs.String("of", "occurrences", "what to count: files (items by how many files they have), occurrences (hashes by how many items have them), or unique (collections by how many hashes only their items have)")
+	algo := fs.String("algo", "sha1", "hash algorithm to compare files by, for occurrences and unique")
+	top := fs.Int("top", 20, "with -of unique, how many collections to print, or all if 0")
+	parseFlags(fs, args)
+
+	storage, err := omnihash.NewReadOnlyStorage(hashesDB)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	switch *of {
+	case "files":
+		return storage.FilesPerItem(func(files, items int64) error {
+			fmt.Printf("%d %d\n", files, items)
+			return nil
+		})
+	case "occurrences":
+		return storage.HashOccurrences(*algo, func(items, hashes int64) error {
+			fmt.Printf("%d %d\n", items, hashes)
+			return nil
+		})
+	case "unique":
+		return storage.UniqueHashes(*algo, *top, func(collection string, hashes int64) error {
+			if collection == "" {
+				collection = "(unknown)"
+			}
+			fmt.Printf("%d %s\n", hashes, collection)
+			return nil
+		})
+	}
+	return fmt.Errorf("-of (%s) must be files, occurrences, or unique", *of)
+}
+
+func queryCmd(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	algo := fs.String("algo", "sha1", "hash algorithm the hashes were computed with")
+	var enc omnihash.HashEncoding
+	fs.TextVar(&enc, "encoding", omnihash.Hex, "read and write hashes in hex, upper-hex, base32, or base64")
+	parseFlags(fs, args)
+
+	storage, err := omnihash.NewReadOnlyStorage(hashesDB)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	for _, arg := range fs.Args() {
+		hash, err := enc.Decode(*algo, arg)
+		if err != nil {
+			return err
+		}
+		names, err := storage.Lookup(*algo, hash)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %s\n", enc.Encode(hash), strings.Join(names, " "))
+	}
+	return nil
+}
+
+// requeueCmd queues finished collections again, e.g. those that failed
+// during an outage.
+func requeueCmd(args []string) error {
+	fs := flag.NewFlagSet("requeue", flag.ExitOnError)
+	var f omnihash.RequeueFilter
+	fs.BoolVar(&f.All, "all", false, "also requeue collections that were crawled to the end, from the start")
+	fs.BoolVar(&f.Sampled, "sampled", false, "also requeue collections a crawl with -sample or -sample-count took a sample of, from the start")
+	fs.StringVar(&f.Reason, "reason", "", "only requeue collections whose error contains this")
+	after := fs.String("after", "", "only requeue collections finished at or after this time (YYYY-MM-DD or RFC 3339)")
+	before := fs.String("before", "", "only requeue collections finished before this time (YYYY-MM-DD or RFC 3339)")
+	parseFlags(fs, args)
+
+	var err error
+	f.After, err = parseTime(*after)
+	if err != nil {
+		return fmt.Errorf("-after: %v", err)
+	}
+	f.Before, err = parseTime(*before)
+	if err != nil {
+		return fmt.Errorf("-before: %v", err)
+	}
+
+	tasks, err := omnihash.NewTasks(tasksDB, omnihash.TasksOptions{})
+	if err != nil {
+		return err
+	}
+	defer tasks.Close()
+
+	n, err := tasks.Requeue(f)
+	if err != nil {
+		return err
+	}
+	log.Printf("requeued %d collections\n", n)
+	return nil
+}
+
+// parseTime parses a date, taken as local midnight, or an RFC 3339 time. An
+// empty string is the zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// dumpCmd prints every distinct hash, one per line, for other tools to
+// consume.
+func dumpCmd(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	algo := fs.String("algo", "sha1", "hash algorithm of the hashes to print")
+	var enc omnihash.HashEncoding
+	fs.TextVar(&enc, "encoding", omnihash.Hex, "write hashes in hex, upper-hex, base32, or base64")
+	parseFlags(fs, args)
+
+	storage, err := omnihash.NewReadOnlyStorage(hashesDB)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	return storage.Hashes(*algo, func(hash []byte) error {
+		_, err := fmt.Fprintln(out, enc.Encode(hash))
+		return err
+	})
+}
+
+// addCmd queues collections, which a running crawl picks up once it's done
+// with its current page. A collection already queued is moved to -page;
+// one already crawled has to be requeued instead.
+func addCmd(args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	page := fs.Int("page", 1, "start crawling the collections at this page")
+	parseFlags(fs, args)
+	if *page < 1 {
+		return fmt.Errorf("need -page (%d) >= 1", *page)
+	}
+
+	tasks, err := omnihash.NewTasks(tasksDB, omnihash.TasksOptions{})
+	if err != nil {
+		return err
+	}
+	defer tasks.Close()
+
+	for _, name := range fs.Args() {
+		moved, err := tasks.Enqueue(name, *page)
+		if errors.Is(err, omnihash.ErrAlreadyDone) {
+			log.Printf("not queueing %s: it was already crawled; requeue it to crawl it again\n", name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if moved {
+			log.Printf("%s was already queued; it now resumes at page %d\n", name, *page)
+		}
+	}
+	return nil
+}
+
+// how many hashes matchCmd looks up per transaction
+const matchBatchSize = 1000
+
+// matchCmd reads hashes, one per line, from a file or stdin and reports
+// which items contain each.
+func matchCmd(args []string) error {
+	fs := flag.NewFlagSet("match", flag.ExitOnError)
+	algo := fs.String("algo", "sha1", "hash algorithm the hashes were computed with")
+	var enc omnihash.HashEncoding
+	fs.TextVar(&enc, "encoding", omnihash.Hex, "read and write hashes in hex, upper-hex, base32, or base64")
+	parseFlags(fs, args)
+
+	in, err := openInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	storage, err := omnihash.NewReadOnlyStorage(hashesDB)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	var hashes [][]byte
+	flush := func() error {
+		err := storage.LookupBatch(*algo, hashes, func(i int, items []string) error {
+			if len(items) == 0 {
+				_, err := fmt.Fprintf(out, "%s missing\n", enc.Encode(hashes[i]))
+				return err
+			}
+			_, err := fmt.Fprintf(out, "%s found %s\n", enc.Encode(hashes[i]), strings.Join(items, " "))
+			return err
+		})
+		hashes = hashes[:0]
+		return err
+	}
+
+	err = scanHashes(in, *algo, enc, func(hash []byte) error {
+		hashes = append(hashes, hash)
+		if len(hashes) == matchBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// intersectCmd reads hashes like matchCmd, but only prints those found
+// in some item, and how many of them there were.
+func intersectCmd(args []string) error {
+	fs := flag.NewFlagSet("intersect", flag.ExitOnError)
+	algo := fs.String("algo", "sha1", "hash algorithm the hashes were computed with")
+	var enc omnihash.HashEncoding
+	fs.TextVar(&enc, "encoding", omnihash.Hex, "read and write hashes in hex, upper-hex, base32, or base64")
+	countOnly := fs.Bool("count-only", false, "only print how many hashes were found")
+	parseFlags(fs, args)
+
+	in, err := openInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	var hashes [][]byte
+	err = scanHashes(in, *algo, enc, func(hash []byte) error {
+		hashes = append(hashes, hash)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	storage, err := omnihash.NewReadOnlyStorage(hashesDB)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	distinct, found, err := storage.Intersect(*algo, hashes, func(hash []byte) error {
+		if *countOnly {
+			return nil
+		}
+		_, err := fmt.Fprintln(out, enc.Encode(hash))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	percent := 0.0
+	if distinct > 0 {
+		percent = float64(found) * 100 / float64(distinct)
+	}
+	// stdout only has the hashes, unless they weren't asked for
+	summary := io.Writer(os.Stderr)
+	if *countOnly {
+		summary = out
+	}
+	_, err = fmt.Fprintf(summary, "%d of %d distinct hashes found (%.2f%%)\n", found, distinct, percent)
+	return err
+}
+
+// openInput opens the file at path, or stdin if path is empty or "-".
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "" || path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// scanHashes calls fn with the hash on each line of in, which should be in
+// enc and of algo. Blank lines are ignored, and others that aren't such a hash
+// are logged and skipped.
+func scanHashes(in io.Reader, algo string, enc omnihash.HashEncoding, fn func(hash []byte) error) error {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		hash, err := enc.Decode(algo, line)
+		if err != nil {
+			log.Printf("skipping: %v\n", err)
+			continue
+		}
+		err = fn(hash)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// mergeCmd adds the items of other hash databases, e.g. from crawls run on
+// other machines, to hashes.db.
+func mergeCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: merge <database>...")
+	}
+	storage, err := omnihash.NewStorage(hashesDB, omnihash.StorageOptions{})
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	for _, src := range args {
+		n, err := storage.Merge(src)
+		if err != nil {
+			return fmt.Errorf("merging %s: %v", src, err)
+		}
+		log.Printf("merged %d new items from %s\n", n, src)
+	}
+	return nil
+}
+
+// deleteCmd removes items from hashes.db and collections from the queue and
+// the list of finished collections, along with the items found in them.
+// Items stored before the collection they were found in was recorded are
+// left; they can be deleted by name.
+func deleteCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: delete <item-or-collection>...")
+	}
+	storage, err := omnihash.NewStorage(hashesDB, omnihash.StorageOptions{})
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	tasks, err := omnihash.NewTasks(tasksDB, omnihash.TasksOptions{})
+	if err != nil {
+		return err
+	}
+	defer tasks.Close()
+
+	for _, name := range args {
+		found, err := storage.Delete(name)
+		if err != nil {
+			return fmt.Errorf("deleting %s: %v", name, err)
+		}
+		if found {
+			log.Printf("deleted item %s\n", name)
+		}
+		items, err := storage.ItemsFoundIn(name)
+		if err != nil {
+			return fmt.Errorf("deleting %s: %v", name, err)
+		}
+		for _, item := range items {
+			_, err = storage.Delete(item)
+			if err != nil {
+				return fmt.Errorf("deleting %s: %v", item, err)
+			}
+		}
+		if len(items) > 0 {
+			log.Printf("deleted %d items found in %s\n", len(items), name)
+		}
+		err = tasks.Forget(name)
+		if err != nil {
+			return fmt.Errorf("deleting %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// vacuumCmd compacts hashes.db. It needs as much free disk space as the
+// database takes, and can't run while a crawl is writing to it.
+func vacuumCmd(args []string) error {
+	storage, err := omnihash.NewStorage(hashesDB, omnihash.StorageOptions{})
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	before, after, err := storage.Vacuum()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d bytes before, %d bytes after\n", before, after)
+	return nil
+}
+
+// itemCmd fetches and stores the items given, without searching for them in
+// a collection or touching the queue.
+func itemCmd(args []string) error {
+	fs := flag.NewFlagSet("item", flag.ExitOnError)
+	collection := fs.String("collection", "", "record the items as found in this collection instead of the first, by name, they belong to")
+	torrents := fs.Bool("torrents", false, "also index info-hashes, as a crawl with -torrents would")
+	derivatives := fs.Bool("derivatives", false, "also index derived files, as a crawl with -derivatives would")
+	keepListings := fs.Bool("keep-listings", false, "also store the file listings, as a crawl with -keep-listings would")
+	baseURL := fs.String("base-url", omnihash.DefaultBaseURL, "send requests here instead of archive.org, such as to a mirror")
+	parseFlags(fs, args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: item [flags] <item>...")
+	}
+	storage, err := omnihash.NewStorage(hashesDB, omnihash.StorageOptions{IndexDerivatives: *derivatives, KeepListings: *keepListings})
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	client := omnihash.Client{BaseURL: *baseURL, Torrents: *torrents}
+	for _, item := range fs.Args() {
+		im, err := omnihash.NewItemMetadata(context.Background(), &client, item)
+		if err != nil {
+			return err
+		}
+		if im.IsCollection {
+			return fmt.Errorf("%s is a collection; crawl it instead", item)
+		}
+		coll := *collection
+		if coll == "" && len(im.Collections) > 0 {
+			coll = im.Collections[0]
+		}
+		err = storage.NewEntry(im, item, coll)
+		if err != nil {
+			return fmt.Errorf("storing %s: %w", item, err)
+		}
+		log.Printf("indexed %s (%d files)\n", item, len(im.Files))
+	}
+	return nil
+}
+
+// explainCmd fetches items and shows which of their files and hashes a crawl
+// would store, and why the others would be left out. Nothing is written.
+func explainCmd(args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	torrents := fs.Bool("torrents", false, "fetch info-hashes, as a crawl with -torrents would")
+	derivatives := fs.Bool("derivatives", false, "keep derived files, as a crawl with -derivatives would")
+	baseURL := fs.String("base-url", omnihash.DefaultBaseURL, "send requests here instead of archive.org, such as to a mirror")
+	parseFlags(fs, args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: explain [flags] <item>...")
+	}
+
+	client := omnihash.Client{BaseURL: *baseURL, Torrents: *torrents}
+	for _, item := range fs.Args() {
+		im, err := omnihash.NewItemMetadata(context.Background(), &client, item)
+		if err != nil {
+			return err
+		}
+		if im.IsCollection {
+			fmt.Printf("%s: collection; its items would be crawled instead\n", item)
+			continue
+		}
+		omnihash.Explain(item, im, *derivatives, func(file, algo, reason string) {
+			name := file
+			if algo != "" {
+				name = "  " + algo
+			}
+			if reason == "" {
+				fmt.Printf("%s: kept\n", name)
+			} else {
+				fmt.Printf("%s: skipped: %s\n", name, reason)
+			}
+		})
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// denylist holds identifiers of items and collections never to crawl, as
+// exact names or path.Match patterns such as "*_backup".
+type denylist []string
+
+// loadDenylist reads a pattern per line of the file at p. Blank lines and
+// those starting with # are ignored.
+func loadDenylist(p string) (denylist, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var d denylist
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, err = path.Match(line, "")
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad pattern %q: %w", p, line, err)
+		}
+		d = append(d, line)
+	}
+	return d, scanner.Err()
+}
+
+func (d denylist) match(name string) bool {
+	for _, pattern := range d {
+		// patterns were checked when loaded
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
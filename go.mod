@@ -2,4 +2,8 @@ module github.com/nathaniel28/acrawl
 
 go 1.22.6
 
-require github.com/mattn/go-sqlite3 v1.14.22 // indirect
+require (
+	github.com/mattn/go-sqlite3 v1.14.22
+	golang.org/x/sync v0.10.0
+	golang.org/x/time v0.10.0
+)
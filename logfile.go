@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file that, once it grows past max bytes, is renamed
+// to path.1, replacing any older one, and started over.
+type rotatingFile struct {
+	mu   sync.Mutex
+	path string
+	max  int64
+	f    *os.File
+	size int64
+}
+
+// openRotatingFile appends to the file at path, never rotating it if max is
+// 0.
+func openRotatingFile(path string, max int64) (*rotatingFile, error) {
+	r := rotatingFile{path: path, max: max}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.max > 0 && r.size > 0 && r.size+int64(len(p)) > r.max {
+		r.f.Close()
+		// if renaming fails, the file just keeps growing
+		err := os.Rename(r.path, r.path+".1")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rotating the log file: %v\n", err)
+		}
+		err = r.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// logLevel is how much is logged: at levelInfo, progress as well as what
+// went wrong, and at levelWarn, only what went wrong and why a crawl stopped.
+type logLevel int
+
+const (
+	levelInfo logLevel = iota
+	levelWarn
+)
+
+// minLevel is set by -log-level.
+var minLevel logLevel
+
+func (l *logLevel) String() string {
+	if *l == levelWarn {
+		return "warn"
+	}
+	return "info"
+}
+
+func (l *logLevel) Set(s string) error {
+	switch s {
+	case "info":
+		*l = levelInfo
+	case "warn":
+		*l = levelWarn
+	default:
+		return fmt.Errorf("%s isn't info or warn", s)
+	}
+	return nil
+}
+
+// infof logs a message about progress, unless -log-level is warn.
+func infof(format string, args ...any) {
+	if minLevel <= levelInfo {
+		log.Printf(format, args...)
+	}
+}
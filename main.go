@@ -1,438 +1,1001 @@
 package main
 
 import (
-	"compress/gzip"
-	"database/sql"
-	"encoding/hex"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"net/http"
 	"os"
 	"os/signal"
-	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/nathaniel28/acrawl/omnihash"
 )
 
-func askArchive(client *http.Client, page string) (*http.Response, io.Reader, error) {
-	req, err := http.NewRequest("GET", page, nil)
-	if err != nil {
-		return nil, nil, err
-	}
-	req.Header.Add("accept-encoding", "gzip")
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, nil, err
-	}
-	var r io.Reader
-	if resp.Header.Get("content-encoding") == "gzip" {
-		r, err = gzip.NewReader(resp.Body)
-		if err != nil {
-			resp.Body.Close()
-			return nil, nil, err
-		}
-	} else {
-		r = resp.Body
-	}
-	return resp, r, nil
-}
-
-func askArchiveForJson(client *http.Client, page string, dst any) error {
-	resp, reader, err := askArchive(client, page)
-	if err != nil {
-		return err
-	}
-	dec := json.NewDecoder(reader)
-	err = dec.Decode(&dst)
-	resp.Body.Close()
-	return err
-}
+// headerFlag collects "Name: value" headers given with repeated flags.
+type headerFlag http.Header
 
-type CollectionSubset struct {
-	Resp struct {
-		Count uint `json:"numFound"`
-		Start uint `json:"start"`
-		Buf   []struct {
-			Name string `json:"identifier"`
-		} `json:"docs"`
-	} `json:"response"`
+func (h headerFlag) String() string {
+	var b strings.Builder
+	http.Header(h).Write(&b)
+	return b.String()
 }
 
-func NewCollectionSubset(client *http.Client, collectionName string, count int, page int) (*CollectionSubset, error) {
-	if count < 1 || page < 1 {
-		return nil, fmt.Errorf("count (%d) and page (%d) must be >= 1", count, page)
+func (h headerFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("%q is not of the form \"Name: value\"", s)
 	}
-	var co CollectionSubset
-	err := askArchiveForJson(client, "https://archive.org/advancedsearch.php?q=collection:"+collectionName+"&fl[]=identifier&rows="+fmt.Sprint(count)+"&page="+fmt.Sprint(page)+"&sort=downloads+desc&output=json", &co)
-	if err != nil {
-		return nil, err
+	name = strings.TrimSpace(name)
+	// responses are only decoded if they're gzipped or not encoded at all
+	if http.CanonicalHeaderKey(name) == "Accept-Encoding" {
+		return fmt.Errorf("%s can't be overridden", name)
 	}
-	return &co, nil
+	http.Header(h).Add(name, strings.TrimSpace(value))
+	return nil
 }
 
-type ItemMetadata struct {
-	Files []struct {
-		Hash string `json:"sha1"`
-		Name string `json:"name"`
-	} `json:"result"`
-	IsCollection bool
+// byteSize is a flag for a number of bytes, optionally with a K, M, G, or T
+// suffix for powers of 1024.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return fmt.Sprint(int64(*b))
 }
 
-func NewItemMetadata(client *http.Client, item string) (*ItemMetadata, error) {
-	var im ItemMetadata
-	var t struct {
-		Mediatype string `json:"result"`
+func (b *byteSize) Set(s string) error {
+	shift := 0
+	if i := strings.IndexAny(s, "KMGTkmgt"); i >= 0 && i == len(s)-1 {
+		shift = 10 * (strings.IndexByte("KMGT", strings.ToUpper(s)[i]) + 1)
+		s = s[:i]
 	}
-	err := askArchiveForJson(client, "https://archive.org/metadata/"+item+"/metadata/mediatype", &t)
+	n, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	im.IsCollection = t.Mediatype == "collection";
-	if im.IsCollection {
-		return &im, nil
+	if n < 0 || n > math.MaxInt64>>shift {
+		return fmt.Errorf("%s is out of range", s)
 	}
-	err = askArchiveForJson(client, "https://archive.org/metadata/"+item+"/files", &im)
-	if err != nil {
-		return nil, err
-	}
-	return &im, nil
+	*b = byteSize(n << shift)
+	return nil
 }
 
-type Storage struct {
-	db      *sql.DB
-	insName *sql.Stmt
-	insHash *sql.Stmt
-}
+const batchSize = 1000
 
-func NewStorage(dbPath string) (*Storage, error) {
-	var s Storage
-	var err error
+// envPrefix is prepended to a flag's name, uppercased and with dashes made
+// underscores, to get the environment variable that sets it: -max-rate can
+// be given as OMNIHASH_MAX_RATE.
+const envPrefix = "OMNIHASH_"
 
-	s.db, err = sql.Open("sqlite3", "hashes.db")
-	if err != nil {
-		log.Fatal(err)
-	}
+// envName returns the environment variable that sets the flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
 
-	_, err = s.db.Exec(`CREATE TABLE IF NOT EXISTS archive_items (
-id INTEGER PRIMARY KEY AUTOINCREMENT,
-name VARCHAR(255) UNIQUE NOT NULL
-);
-CREATE TABLE IF NOT EXISTS hashes (
-hash BINARY(20) PRIMARY KEY,
-item INTEGER,
-FOREIGN KEY (item) REFERENCES archive_items(id)
-);`)
-	if err != nil {
-		return nil, err
+// parseFlags parses args into fs after setting each flag from its environment
+// variable, if that is set. A flag given in args therefore overrides the
+// environment, which overrides the flag's default. There is no config file.
+// The defaults printed in the usage message are left alone, so secrets from
+// the environment are never shown there.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		fs.PrintDefaults()
+		// the example is a flag the command has
+		example := "max-rate"
+		if fs.Lookup(example) == nil {
+			example = ""
+			fs.VisitAll(func(f *flag.Flag) {
+				if example == "" {
+					example = f.Name
+				}
+			})
+		}
+		fmt.Fprintf(fs.Output(), "Each flag can also be set in the environment, e.g. -%s as %s.\n", example, envName(example))
 	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if givenFlags[f.Name] {
+			// already set from args, before the command
+			return
+		}
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		err := fs.Set(f.Name, value)
+		if err != nil {
+			log.Fatalf("$%s: %v\n", name, err)
+		}
+	})
+	fs.Parse(args)
+}
 
-	s.insName, err = s.db.Prepare(`INSERT INTO archive_items (name) VALUES (?);`)
-	if err != nil {
-		s.Close()
-		return nil, err
-	}
-	s.insHash, err = s.db.Prepare(`INSERT INTO hashes (hash, item) VALUES (?, ?);`)
-	if err != nil {
-		s.Close()
-		return nil, err
-	}
+// where the hash database and the task queue are kept; relative paths are
+// taken from -dir, if it's given
+var (
+	hashesDB = "hashes.db"
+	tasksDB  = "working.db"
+	dbDir    string
+)
 
-	return &s, nil
+// dbFlags adds the flags that set hashesDB, tasksDB, and dbDir to fs,
+// defaulting to what they already are, along with -log-level.
+func dbFlags(fs *flag.FlagSet) {
+	fs.StringVar(&hashesDB, "hashes-db", hashesDB, "keep hashes in this database")
+	fs.StringVar(&tasksDB, "tasks-db", tasksDB, "keep the queue of collections, failed items, and cached validators in this database")
+	fs.StringVar(&dbDir, "dir", dbDir, "take relative -hashes-db and -tasks-db paths from this directory, creating it if need be")
+	fs.Var(&minLevel, "log-level", "log progress as well as problems (info), or only problems and why a crawl stopped (warn)")
 }
 
-func (s *Storage) Close() {
-	if s.insHash != nil {
-		s.insHash.Close()
-	}
-	if s.insName != nil {
-		s.insName.Close()
-	}
-	if s.db != nil {
-		s.db.Close()
+// the flags globalFlags found in args, which the environment mustn't override
+// when a command parses them again
+var givenFlags = make(map[string]bool)
+
+// globalFlags parses the flags dbFlags adds at the start of args, so they can
+// be given before a command, and returns the rest.
+func globalFlags(args []string) []string {
+	fs := flag.NewFlagSet("omnihash", flag.ExitOnError)
+	dbFlags(fs)
+	n := 0
+	for n < len(args) {
+		name, _, hasValue := strings.Cut(strings.TrimLeft(args[n], "-"), "=")
+		if !strings.HasPrefix(args[n], "-") || fs.Lookup(name) == nil {
+			break
+		}
+		n++
+		if !hasValue && n < len(args) {
+			n++
+		}
 	}
+	parseFlags(fs, args[:n])
+	fs.Visit(func(f *flag.Flag) {
+		givenFlags[f.Name] = true
+	})
+	return args[n:]
 }
 
-func (s *Storage) NewEntry(im *ItemMetadata, item string) (err error) {
-	if len(im.Files) == 0 {
-		return fmt.Errorf("no files")
-	}
-
-	tx, err := s.db.Begin()
-	if err != nil {
+// resolveDBs applies dbDir to the database paths.
+func resolveDBs() {
+	if dbDir == "" {
 		return
 	}
-
-	res, err := s.insName.Exec(item)
+	err := os.MkdirAll(dbDir, 0755)
 	if err != nil {
-		tx.Rollback()
-		return
+		log.Fatal(err)
 	}
-	id, err := res.LastInsertId()
-	if err != nil {
-		tx.Rollback()
-		return
+	if !filepath.IsAbs(hashesDB) {
+		hashesDB = filepath.Join(dbDir, hashesDB)
+	}
+	if !filepath.IsAbs(tasksDB) {
+		tasksDB = filepath.Join(dbDir, tasksDB)
 	}
+}
 
-	inserted := false
-	for _, f := range im.Files {
-		if f.Name == "__ia_thumb.jpg" {
-			continue
-		}
-		if strings.HasPrefix(f.Name, item) {
-			suffix := f.Name[len(item):]
-			if suffix == "_archive.torrent" || suffix == "_files.xml" || suffix == "_meta.sqlite" || suffix == "_meta.xml" || suffix == "_reviews.xml" {
-				continue
+func main() {
+	args := globalFlags(os.Args[1:])
+	if len(args) > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			resolveDBs()
+			err := cmd(args[1:])
+			if err != nil {
+				log.Fatal(err)
 			}
+			return
 		}
+	}
+	crawl(args)
+}
 
-		if len(f.Hash) != 40 {
-			log.Printf("item %s: file %s: hash '%s' would not be 20 bytes\n", item, f.Name, f.Hash)
-			continue
+func crawl(args []string) {
+	fs := flag.NewFlagSet("crawl", flag.ExitOnError)
+	minRate := fs.Float64("min-rate", 0.1, "never send fewer than this many requests per second")
+	maxRate := fs.Float64("max-rate", 2, "never send more than this many requests per second")
+	burst := fs.Int("burst", 1, "how many requests to a host may be sent back to back")
+	jitter := fs.Float64("jitter", 0.2, "randomly vary the delay between requests by up to this fraction")
+	breakerThreshold := fs.Int("breaker-threshold", 10, "pause all requests after this many fail in a row")
+	breakerCooldown := fs.Duration("breaker-cooldown", 5*time.Minute, "how long to pause requests after repeated failures")
+	minDownloads := fs.Int("min-downloads", 0, "skip items downloaded fewer times than this, except collections")
+	maxItems := fs.Int64("max-items", 0, "stop after fetching this many items, if > 0; the crawl can be resumed later")
+	maxDuration := fs.Duration("max-duration", 0, "stop after crawling for this long, if > 0, letting items in flight finish as on an interrupt; the crawl can be resumed later")
+	maxRequests := fs.Int64("max-requests", 0, "stop after sending this many requests of any kind, if > 0; the crawl can be resumed later")
+	var maxDBSize byteSize
+	fs.Var(&maxDBSize, "max-db-size", "stop once the hash database takes more than this many bytes, if > 0; K, M, G, and T suffixes are allowed")
+	onDuplicate := fs.String("on-duplicate", "error", "when an item is already stored, such as by an overlapping crawl, count it as failed (error), leave it be (skip), or add the files and hashes it lacks (merge)")
+	var smp sampler
+	fs.Float64Var(&smp.fraction, "sample", 0, "only fetch this fraction (0 to 1) of the items on each page, chosen at random, recording the collections as sampled rather than completed; for a quick look at what a huge collection holds")
+	fs.IntVar(&smp.count, "sample-count", 0, "like -sample, but fetch this many items of each page")
+	fs.Uint64Var(&smp.seed, "sample-seed", 1, "seed for choosing the items -sample and -sample-count fetch; the same seed picks the same items")
+	retries := fs.Int("retries", 2, "how many more times to try fetching an item after a transient error")
+	busyRetries := fs.Int("busy-retries", omnihash.DefaultBusyRetries, "how many times to try a database write, such as storing a batch of items, while another process holds the database locked")
+	workers := fs.Int("workers", 1, "how many items to fetch at once; requests are still limited by -max-rate")
+	itemTimeout := fs.Duration("item-timeout", 0, "if > 0, give up on an item whose requests take longer than this altogether, such as one with an enormous file listing, recording it as failed; it isn't retried until -resume-failed")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 30*time.Second, "when stopping, how long to let items being fetched finish before abandoning them")
+	noTUI := fs.Bool("no-tui", false, "log progress instead of showing a dashboard, even on a terminal")
+	metricsAddr := fs.String("metrics-addr", "", "serve Prometheus metrics at /metrics on this address")
+	conditional := fs.Bool("conditional", false, "skip items whose file listing hasn't changed since they were last fetched")
+	accessKey := fs.String("access-key", "", "archive.org S3 access key")
+	secretKey := fs.String("secret-key", "", "archive.org S3 secret key")
+	derivatives := fs.Bool("derivatives", false, "also index files archive.org derived from the uploaded ones, such as OCR text or transcoded audio")
+	keepListings := fs.Bool("keep-listings", false, "also store each item's file listing, gzipped, so the reparse command can fill in what later versions store without fetching it again; makes the database much larger")
+	indexCollections := fs.Bool("index-collections", false, "also store the files of the collections crawled, such as their logos, marked as a collection's in the database")
+	torrents := fs.Bool("torrents", false, "also index the BitTorrent info-hash of each item's _archive.torrent, as algorithm btih")
+	shards := fs.Int("shards", 0, "split a new hash database into this many files (2 to 256) by hash prefix; later runs and commands find the shards on their own")
+	notifyURL := fs.String("notify-url", "", "POST a JSON summary here once every collection has been crawled")
+	baseURL := fs.String("base-url", omnihash.DefaultBaseURL, "send requests here instead of archive.org, such as to a mirror")
+	noGzip := fs.Bool("no-gzip", false, "ask for uncompressed responses, e.g. to debug with a packet capture or a proxy")
+	output := fs.String("output", "sqlite", "store hashes in -hashes-db (sqlite), or write them as lines of JSON (jsonl) without touching the database")
+	outputFile := fs.String("output-file", "", "with -output jsonl, append lines to this file instead of writing them to stdout")
+	logFile := fs.String("log-file", "", "write log messages to this file instead of stderr")
+	logMaxSize := byteSize(100 << 20)
+	fs.Var(&logMaxSize, "log-max-size", "once -log-file grows past this many bytes, rename it with a .1 suffix and start it over, if > 0; K, M, G, and T suffixes are allowed")
+	checkpointFile := fs.String("checkpoint-file", "", "keep the queue of collections and those finished in this JSON file instead of -tasks-db, saved every few pages and on exit; skipped items aren't recorded")
+	maxDepth := fs.Int("max-depth", omnihash.DefaultMaxDepth, "follow sub-collections at most this many levels below the collections given")
+	noRecurse := fs.Bool("no-recurse", false, "never follow sub-collections, only crawling the collections given; the same as -max-depth 0")
+	denylistFile := fs.String("denylist", "", "never crawl the items or collections named in this file, one per line; * and ? wildcards are allowed")
+	resumeFailed := fs.Bool("resume-failed", false, "instead of crawling, fetch again the items that failed before, one at a time, and stop")
+	sharedDB := fs.Bool("shared-db", false, "allow -hashes-db and -tasks-db to be the same file, such as through a symlink")
+	headers := make(headerFlag)
+	fs.Var(headers, "header", "send this \"Name: value\" header with every request; may be repeated")
+	dbFlags(fs)
+	parseFlags(fs, args)
+	resolveDBs()
+	if *minRate <= 0 || *maxRate < *minRate {
+		log.Fatalf("need 0 < -min-rate (%v) <= -max-rate (%v)\n", *minRate, *maxRate)
+	}
+	if *burst < 1 {
+		log.Fatalf("need -burst (%v) >= 1\n", *burst)
+	}
+	if *jitter < 0 || *jitter >= 1 {
+		log.Fatalf("need 0 <= -jitter (%v) < 1\n", *jitter)
+	}
+	if *workers < 1 {
+		log.Fatalf("need -workers (%v) >= 1\n", *workers)
+	}
+	if *itemTimeout < 0 {
+		log.Fatalf("need -item-timeout (%v) >= 0\n", *itemTimeout)
+	}
+	if *busyRetries < 1 {
+		log.Fatalf("need -busy-retries (%v) >= 1\n", *busyRetries)
+	}
+	if smp.fraction < 0 || smp.fraction > 1 || smp.count < 0 || (smp.fraction > 0 && smp.count > 0) {
+		log.Fatalf("need 0 <= -sample (%v) <= 1 and -sample-count (%v) >= 0, not both set\n", smp.fraction, smp.count)
+	}
+	if *maxDepth < 0 {
+		log.Fatalf("need -max-depth (%v) >= 0\n", *maxDepth)
+	}
+	// their tables don't overlap, but a shared file is far more likely a
+	// mistake than a choice
+	if !*sharedDB && sameFile(hashesDB, tasksDB) {
+		log.Fatalf("%s and %s are the same file; pass -shared-db if that's intended\n", hashesDB, tasksDB)
+	}
+	for _, path := range []string{*logFile, *outputFile, *checkpointFile} {
+		if path != "" && (sameFile(path, hashesDB) || sameFile(path, tasksDB)) {
+			log.Fatalf("%s is a database; not writing over it\n", path)
 		}
-		var hexed []byte
-		hexed, err = hex.DecodeString(f.Hash)
+	}
+	// the dashboard sends log output here as well
+	var logOut io.Writer
+	if *logFile != "" {
+		f, err := openRotatingFile(*logFile, int64(logMaxSize))
 		if err != nil {
-			log.Printf("item %s: %v in %s\n", item, err, f.Hash)
-			err = nil
-			continue
+			log.Fatal(err)
 		}
-		res, err = s.insHash.Exec(hexed, id)
+		defer f.Close()
+		log.SetOutput(f)
+		logOut = f
+	}
+	if *output != "sqlite" && *output != "jsonl" {
+		log.Fatalf("-output (%s) must be sqlite or jsonl\n", *output)
+	}
+	if *output == "jsonl" && (*shards > 0 || maxDBSize > 0 || *keepListings) {
+		log.Fatal("-shards, -max-db-size, and -keep-listings need -output sqlite")
+	}
+	if *resumeFailed && *checkpointFile != "" {
+		log.Fatal("-resume-failed needs the failed items in -tasks-db, not -checkpoint-file")
+	}
+
+	var storageOpts omnihash.StorageOptions
+	switch *onDuplicate {
+	case "error":
+		storageOpts.OnDuplicate = omnihash.DuplicateError
+	case "skip":
+		storageOpts.OnDuplicate = omnihash.DuplicateSkip
+	case "merge":
+		storageOpts.OnDuplicate = omnihash.DuplicateMerge
+	default:
+		log.Fatalf("-on-duplicate (%s) must be error, skip, or merge\n", *onDuplicate)
+	}
+	storageOpts.IndexDerivatives = *derivatives
+	storageOpts.KeepListings = *keepListings
+	storageOpts.BusyRetries = *busyRetries
+	tasksOpts := omnihash.TasksOptions{BusyRetries: *busyRetries, MaxDepth: *maxDepth}
+	if *noRecurse {
+		tasksOpts.MaxDepth = 0
+	}
+
+	var denied denylist
+	if *denylistFile != "" {
+		var err error
+		denied, err = loadDenylist(*denylistFile)
 		if err != nil {
-			log.Printf("item %s: file %s: %v\n", item, f.Name, err)
-			err = nil
-			continue
-			//tx.Rollback()
-			//return
+			log.Fatal(err)
 		}
-		inserted = true
-	}
-	if !inserted {
-		tx.Rollback()
-		return fmt.Errorf("no valid files")
 	}
 
-	tx.Commit()
-	return
-}
-
-type Job struct {
-	collection string
-	page       int
-}
-
-type Tasks struct {
-	db        *sql.DB
-	next      *sql.Stmt
-	increment *sql.Stmt
-	add       *sql.Stmt
-	remove    *sql.Stmt
-	remember  *sql.Stmt
-	hasDone   *sql.Stmt
-	length    int
-}
-
-func NewTasks(dbPath string) (*Tasks, error) {
-	// yes, this code is ugly. no, I don't know a better way
-
-	var t Tasks
+	// nil with -output jsonl; the task queue is still kept in tasksDB
+	var storage *omnihash.Storage
+	var sink omnihash.Sink
 	var err error
+	if *output == "jsonl" {
+		out := os.Stdout
+		if *outputFile != "" {
+			out, err = os.OpenFile(*outputFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer out.Close()
+		}
+		sink = omnihash.NewJSONLines(out, *derivatives)
+	} else {
+		if *shards > 0 {
+			storage, err = omnihash.NewShardedStorage(hashesDB, *shards, storageOpts)
+		} else {
+			storage, err = omnihash.NewStorage(hashesDB, storageOpts)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer storage.Close()
+		sink = storage
+	}
+	// opened before the writer, which saves validators as it stores items,
+	// so it's closed after
+	var cache *omnihash.ValidatorCache
+	if *conditional {
+		cache, err = omnihash.NewValidatorCache(tasksDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer cache.Close()
+	}
+	writer := omnihash.NewWriter(sink)
+	writer.Cache = cache
+	defer func() {
+		// everything fetched is written before the database is closed
+		writer.Close()
+		if storage == nil {
+			return
+		}
+		err := storage.Flush()
+		if err != nil {
+			log.Println(err)
+		}
+	}()
 
-	t.db, err = sql.Open("sqlite3", dbPath)
-	if err != nil {
-		return nil, err
-	}
-
-	_, err = t.db.Exec(`CREATE TABLE IF NOT EXISTS jobs (
-name VARCHAR(255) PRIMARY KEY,
-page INTEGER
-);
-CREATE INDEX IF NOT EXISTS idx_page ON jobs(page);
-CREATE TABLE IF NOT EXISTS done (
-name VARCHAR(255) PRIMARY KEY,
-page INTEGER,
-reason TEXT
-)`)
-	if err != nil {
-		t.Close()
-		return nil, err
-	}
-
-	err = t.db.QueryRow(`SELECT COUNT(*) FROM jobs;`).Scan(&t.length)
-	if err != nil {
-		t.Close()
-		return nil, err
-	}
-
-	t.next, err = t.db.Prepare(`SELECT name, page FROM jobs ORDER BY page ASC LIMIT 1;`)
-	if err != nil {
-		t.Close()
-		return nil, err
-	}
-	t.increment, err = t.db.Prepare(`UPDATE jobs SET page = page + 1 WHERE name = (?);`)
-	if err != nil {
-		t.Close()
-		return nil, err
-	}
-	t.add, err = t.db.Prepare(`INSERT INTO jobs (name, page) VALUES (?, ?) ON CONFLICT DO NOTHING;`)
-	if err != nil {
-		t.Close()
-		return nil, err
-	}
-	t.remove, err = t.db.Prepare(`DELETE FROM jobs WHERE name = (?);`)
-	if err != nil {
-		t.Close()
-		return nil, err
-	}
-	t.remember, err = t.db.Prepare(`INSERT INTO done (name, page, reason) VALUES (?, ?, ?);`)
-	if err != nil {
-		t.Close()
-		return nil, err
-	}
-	t.hasDone, err = t.db.Prepare(`SELECT 1 FROM done WHERE name = (?);`)
-	if err != nil {
-		t.Close()
-		return nil, err
-	}
-
-	return &t, nil
-}
-
-func (t *Tasks) Len() int { return t.length }
-
-func (t *Tasks) Next() *Job {
-	var job Job
-	err := t.next.QueryRow().Scan(&job.collection, &job.page)
-	if err != nil {
-		log.Fatal(err)
+	var tasks omnihash.TaskQueue
+	if *checkpointFile != "" {
+		tasks, err = omnihash.NewFileTasks(*checkpointFile, tasksOpts)
+	} else {
+		tasks, err = omnihash.NewTasks(tasksDB, tasksOpts)
 	}
-	return &job
-}
-
-func (t *Tasks) Increment(name string) {
-	_, err := t.increment.Exec(name)
 	if err != nil {
 		log.Fatal(err)
 	}
-}
-
-func (t *Tasks) Add(name string) {
-	var done int
-	err := t.hasDone.QueryRow().Scan(&done)
-	if err == nil && done == 1 {
-		return
-	}
-	_, err = t.add.Exec(name, int(1))
-	if err != nil {
-		log.Fatal(err)
+	defer tasks.Close()
+	for _, name := range fs.Args() {
+		if denied.match(name) {
+			log.Printf("not queueing %s: denylisted\n", name)
+			continue
+		}
+		tasks.Add(name, 1, 0)
+	}
+
+	client := omnihash.Client{
+		Limiter:     omnihash.NewAdaptiveLimiter(*minRate, *maxRate, *burst, *jitter),
+		Breaker:     omnihash.NewBreaker(*breakerThreshold, *breakerCooldown),
+		Headers:     http.Header(headers),
+		BaseURL:     *baseURL,
+		Torrents:    *torrents,
+		NoGzip:      *noGzip,
+		MaxRequests: *maxRequests,
+		ItemTimeout: *itemTimeout,
+		Cache:       cache,
+	}
+	if (*accessKey == "") != (*secretKey == "") {
+		log.Fatal("need both an access key and a secret key, or neither")
+	}
+	if *accessKey != "" {
+		client.Credentials = *accessKey + ":" + *secretKey
+		infof("authenticating with archive.org S3 credentials\n")
+	}
+
+	omnihash.DefaultMetrics.Rate = client.Limiter.Rate
+	omnihash.DefaultMetrics.WriteQueue = writer.Len
+	// the dashboard would be mixed into lines of JSON on stdout
+	toStdout := *output == "jsonl" && *outputFile == ""
+	if !*noTUI && !toStdout && isTerminal(os.Stdout) {
+		dashboard := StartDashboard(os.Stdout, logOut)
+		defer dashboard.Stop()
+	}
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", &omnihash.DefaultMetrics)
+		go func() {
+			log.Println(http.ListenAndServe(*metricsAddr, mux))
+		}()
+	}
+
+	// for the collections crawled so far this run
+	summaries := make(map[string]*omnihash.Summary)
+	var processed atomic.Int64
+
+	// finish records that job's collection was crawled to the end
+	finish := func(job *omnihash.Job, status omnihash.DoneStatus, sum *omnihash.Summary) {
+		writer.Sync()
+		reason := ""
+		// so it isn't taken to be fully indexed
+		if smp.enabled() && status == omnihash.DoneCompleted {
+			status, reason = omnihash.DoneSampled, smp.String()
+		}
+		tasks.Remove(job, status, reason, sum)
+		delete(summaries, job.Collection)
+		infof("finished %s: %d items indexed, %d skipped, %d failed\n", job.Collection, sum.Indexed.Load(), sum.Skipped.Load(), sum.Failed.Load())
 	}
-	t.length++
-}
 
-func (t *Tasks) Remove(job *Job, reason string) {
-	_, err := t.remove.Exec(job.collection)
-	if err != nil {
-		log.Fatal(err)
-	}
-	_, err = t.remember.Exec(job.collection, job.page, reason)
-	if err != nil {
-		log.Printf("failed to remember deletion of %v %v by reason %v: %v\n", job.collection, job.page, reason, err)
+	var est omnihash.Estimator
+	// estimate logs how long the rest of the queue should take, at the
+	// rate pages have been walked, or before that at the rate requests are
+	// allowed, as each item costs about one
+	estimate := func() {
+		items, unknown, err := tasks.Remaining(batchSize)
+		if err != nil {
+			log.Printf("counting the queued items: %v\n", err)
+			return
+		}
+		eta, ok := est.ETA(items, client.Limiter.Rate())
+		if !ok {
+			omnihash.DefaultMetrics.SetETA(-1, items)
+			return
+		}
+		omnihash.DefaultMetrics.SetETA(eta, items)
+		if items == 0 && unknown == 0 {
+			return
+		}
+		msg := fmt.Sprintf("about %v left for %d queued items", eta.Round(time.Second), items)
+		if unknown > 0 {
+			msg += fmt.Sprintf(", plus %d collections of unknown size", unknown)
+		}
+		infof("%s\n", msg)
 	}
-	t.length--
-}
 
-func (t *Tasks) Close() {
-	if t.next != nil {
-		t.next.Close()
-	}
-	if t.increment != nil {
-		t.increment.Close()
-	}
-	if t.add != nil {
-		t.add.Close()
-	}
-	if t.remove != nil {
-		t.remove.Close()
-	}
-	if t.remember != nil {
-		t.remember.Close()
+	// cancelled to abandon whatever requests are still being made
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := time.Now()
+	intr := make(chan os.Signal, 1)
+	signal.Notify(intr, os.Interrupt)
+	if pauseSignal != nil {
+		go pauseOnSignal(client.Limiter)
 	}
-	if t.hasDone != nil {
-		t.hasDone.Close()
+	// never ready without -max-duration
+	var timeUp <-chan time.Time
+	if *maxDuration > 0 {
+		t := time.NewTimer(*maxDuration)
+		defer t.Stop()
+		timeUp = t.C
 	}
-	if t.db != nil {
-		t.db.Close()
+	logTimeUp := func() {
+		log.Printf("reached -max-duration (%v) after %v; stopping\n", *maxDuration, time.Since(started).Round(time.Second))
 	}
-}
 
-const batchSize = 1000
-
-func main() {
-	storage, err := NewStorage("hashes.db")
-	if err != nil {
-		log.Fatal(err)
+	if *resumeFailed {
+		retryFailed(ctx, &client, tasks.(*omnihash.Tasks), writer, intr, timeUp)
+		return
 	}
-	defer storage.Close()
 
-	tasks, err := NewTasks("working.db")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer tasks.Close()
-	for i := 1; i < len(os.Args); i++ {
-		tasks.Add(os.Args[i])
+	// get fetches item, found in collection, retrying transient errors. It
+	// returns nil if there's nothing to store, having counted why in sum,
+	// or if the crawl is shutting down, in which case the item is fetched
+	// again when it resumes.
+	get := func(item, collection string, sum *omnihash.Summary) *omnihash.ItemMetadata {
+		im, err := omnihash.NewItemMetadata(ctx, &client, item)
+		for attempt := 0; attempt < *retries && omnihash.Transient(err); attempt++ {
+			omnihash.DefaultMetrics.Retries.Add(1)
+			log.Printf("retrying %s after %v\n", item, err)
+			t := time.NewTimer(time.Second << attempt)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+			}
+			im, err = omnihash.NewItemMetadata(ctx, &client, item)
+		}
+		if ctx.Err() != nil || errors.Is(err, omnihash.ErrRequestBudget) {
+			return nil
+		}
+		omnihash.DefaultMetrics.ItemsProcessed.Add(1)
+		if errors.Is(err, omnihash.ErrNotModified) {
+			sum.Skipped.Add(1)
+			return nil
+		}
+		if err != nil {
+			log.Println(err)
+			tasks.Fail(item, collection, err)
+			sum.Failed.Add(1)
+			omnihash.DefaultMetrics.ItemsFailed.Add(1)
+			return nil
+		}
+		return im
+	}
+
+	// walk has the workers fetch each of names with fetch, stopping early
+	// on an interrupt or once a limit is reached. It reports whether it
+	// stopped, in which case the crawl must too, once walk has given the
+	// items in flight a chance to finish.
+	walk := func(names []string, fetch func(item string)) bool {
+		items := make(chan string)
+		var wg sync.WaitGroup
+		var inFlight atomic.Int64
+		for range *workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for item := range items {
+					inFlight.Add(1)
+					fetch(item)
+					inFlight.Add(-1)
+				}
+			}()
+		}
+		stopping := false
+	dispatch:
+		for _, name := range names {
+			if *maxItems > 0 && processed.Add(1) > *maxItems {
+				log.Printf("reached -max-items (%d); stopping\n", *maxItems)
+				stopping = true
+				break
+			}
+			if client.BudgetSpent() {
+				stopping = true
+				break
+			}
+			select {
+			case items <- name:
+			case <-intr:
+				log.Println("interrupted; shutting down safely")
+				stopping = true
+				break dispatch
+			case <-timeUp:
+				logTimeUp()
+				stopping = true
+				break dispatch
+			}
+		}
+		close(items)
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		if !stopping {
+			select {
+			case <-done:
+			case <-intr:
+				log.Println("interrupted; shutting down safely")
+				stopping = true
+			case <-timeUp:
+				logTimeUp()
+				stopping = true
+			}
+		}
+		// items refused a request are only fetched once the crawl resumes
+		if client.BudgetSpent() {
+			log.Printf("reached -max-requests (%d); stopping\n", *maxRequests)
+			stopping = true
+		}
+		if stopping {
+			drain(done, &inFlight, *shutdownTimeout, cancel)
+		}
+		return stopping
+	}
+
+	// only kept in -tasks-db, so a crawl with -checkpoint-file leaves them
+	// queued
+	queue, _ := tasks.(*omnihash.Tasks)
+	// fetchQueued fetches and stores items queued by themselves, such as by
+	// the watch command, replacing what is stored under their names, and
+	// takes them off the queue. It reports whether the crawl must stop, in
+	// which case they're left queued to be fetched again.
+	fetchQueued := func(batch []omnihash.QueuedItem) bool {
+		var sum omnihash.Summary
+		byName := make(map[string]omnihash.QueuedItem)
+		var names []string
+		for _, it := range batch {
+			if denied.match(it.Name) {
+				tasks.Skip(it.Name, "", "denylisted")
+				sum.Skipped.Add(1)
+				continue
+			}
+			byName[it.Name] = it
+			names = append(names, it.Name)
+		}
+		stopping := walk(names, func(item string) {
+			it := byName[item]
+			im := get(item, "", &sum)
+			if im == nil {
+				return
+			}
+			collection := ""
+			for _, c := range it.Collections {
+				if slices.Contains(im.Collections, c) {
+					collection = c
+					break
+				}
+			}
+			// collections are crawled rather than fetched by themselves
+			if im.IsCollection || (it.OnlyCollections && collection == "") {
+				sum.Skipped.Add(1)
+				return
+			}
+			if collection == "" && len(im.Collections) > 0 {
+				collection = im.Collections[0]
+			}
+			writer.Replace(ctx, item, collection, im, &sum)
+		})
+		if stopping {
+			return true
+		}
+		// as with a page, they're only done once they're stored
+		writer.Sync()
+		err := queue.Unqueue(batch)
+		if err != nil {
+			log.Printf("taking fetched items off the queue: %v\n", err)
+			return true
+		}
+		infof("fetched %d queued items: %d indexed, %d skipped, %d failed\n", len(batch), sum.Indexed.Load(), sum.Skipped.Load(), sum.Failed.Load())
+		return false
 	}
 
-	var client http.Client
-
-	intr := make(chan os.Signal, 1)
-	signal.Notify(intr, os.Interrupt)
-
-	for tasks.Len() > 0 {
+	for {
 		select {
 		case <-intr:
-			log.Println("interrupted; shut down safely")
+			log.Println("interrupted; shutting down safely")
+			return
+		case <-timeUp:
+			logTimeUp()
 			return
 		default:
 			break
 		}
+		// checked between pages, so the crawl can resume where it stopped
+		if maxDBSize > 0 {
+			size, err := storage.Size()
+			if err != nil {
+				log.Printf("getting the database size: %v\n", err)
+				return
+			}
+			if size > int64(maxDBSize) {
+				log.Printf("stopping: the database takes %d bytes, over -max-db-size (%d)\n", size, maxDBSize)
+				return
+			}
+		}
 
-		job := tasks.Next()
-
-		co, err := NewCollectionSubset(&client, job.collection, batchSize, job.page)
-		if err != nil {
-			job.page++
-			co, err = NewCollectionSubset(&client, job.collection, batchSize, job.page)
+		// items queued by themselves go before the pages of collections
+		if queue != nil {
+			batch, err := queue.QueuedItems(batchSize)
 			if err != nil {
-				tasks.Remove(job, fmt.Sprint(err))
-				log.Printf("removed %v due to error %v\n", job.collection, err)
+				log.Printf("getting the queued items: %v\n", err)
+				return
+			}
+			if len(batch) > 0 {
+				if fetchQueued(batch) {
+					return
+				}
 				continue
 			}
-			tasks.Increment(job.collection)
 		}
 
-		if len(co.Resp.Buf) == 0 /*|| job.page > foo*/ {
-			tasks.Remove(job, "")
+		queued, err := tasks.Len()
+		if err != nil {
+			log.Printf("counting the queued jobs: %v\n", err)
+			return
+		}
+		omnihash.DefaultMetrics.QueueLength.Store(int64(queued))
+		job, ok, err := tasks.Next()
+		if err != nil {
+			log.Printf("getting the next job: %v\n", err)
+			return
+		}
+		if !ok {
+			infof("no more collections to crawl\n")
+			if *notifyURL != "" {
+				notify(*notifyURL, started)
+			}
+			return
+		}
+		// queued before it was denylisted
+		if denied.match(job.Collection) {
+			log.Printf("not crawling %s: denylisted\n", job.Collection)
+			tasks.Remove(job, omnihash.DoneDenylisted, "", nil)
 			continue
 		}
-		for _, itm := range co.Resp.Buf {
-			time.Sleep(1000 * time.Millisecond)
-			im, err := NewItemMetadata(&client, itm.Name)
-			if err != nil {
-				log.Println(err)
+
+		pageStarted := time.Now()
+		omnihash.DefaultMetrics.SetJob(job.Collection, job.Page)
+		sum, ok := summaries[job.Collection]
+		if !ok {
+			sum = &omnihash.Summary{}
+			summaries[job.Collection] = sum
+			if job.Page > 1 {
+				infof("resuming %s at page %d, %d items indexed so far\n", job.Collection, job.Page, job.Indexed)
+			}
+		}
+		// to count what this page adds to job.Indexed
+		indexedBefore := sum.Indexed.Load()
+
+		co, err := omnihash.NewCollectionSubset(ctx, &client, job.Collection, batchSize, job.Page)
+		if err != nil && !errors.Is(err, omnihash.ErrRequestBudget) {
+			// the same page once more; skipping to the next would lose
+			// this one's items for good
+			omnihash.DefaultMetrics.Retries.Add(1)
+			log.Printf("retrying page %d of %s after %v\n", job.Page, job.Collection, err)
+			co, err = omnihash.NewCollectionSubset(ctx, &client, job.Collection, batchSize, job.Page)
+			if err != nil && !errors.Is(err, omnihash.ErrRequestBudget) {
+				writer.Sync()
+				tasks.Remove(job, omnihash.DoneError, fmt.Sprint(err), sum)
+				delete(summaries, job.Collection)
+				log.Printf("removed %v due to error %v\n", job.Collection, err)
 				continue
 			}
+		}
+
+		if err != nil {
+			// the job isn't checkpointed, so its page is fetched again
+			// when the crawl resumes
+			log.Printf("reached -max-requests (%d); stopping\n", *maxRequests)
+			return
+		}
+
+		job.Total = max(job.Total, co.NumFound())
+
+		// normally the last page is recognized by numFound below, but the
+		// collection may have shrunk since the previous page
+		if len(co.Resp.Buf) == 0 {
+			status := omnihash.DoneCompleted
+			if job.Page == 1 {
+				status = omnihash.DoneEmpty
+			}
+			finish(job, status, sum)
+			continue
+		}
+		fetch := func(item string) {
+			im := get(item, job.Collection, sum)
+			if im == nil {
+				return
+			}
 			if im.IsCollection {
-				tasks.Add(itm.Name)
+				switch {
+				case item == job.Collection:
+					// fetched to store its files; it's already queued
+				case job.Depth >= tasksOpts.MaxDepth:
+					tasks.Skip(item, job.Collection, fmt.Sprintf("sub-collection past -max-depth (%d)", tasksOpts.MaxDepth))
+				default:
+					tasks.Add(item, 1, job.Depth+1)
+				}
+				if !*indexCollections || len(im.Files) == 0 {
+					sum.Skipped.Add(1)
+					return
+				}
+			} else if item == job.Collection {
+				// crawled as a collection, but its metadata says otherwise
+				return
+			}
+			// blocks while the writer is behind, which holds back
+			// fetching too
+			writer.Write(ctx, item, job.Collection, im, sum)
+		}
+		// sub-collections are stored as they're found among the items of
+		// their parent
+		if *indexCollections && job.Depth == 0 && job.Page == 1 {
+			fetch(job.Collection)
+		}
+		var names []string
+		picked := smp.pick(job.Collection, job.Page, len(co.Resp.Buf))
+		for i, itm := range co.Resp.Buf {
+			if picked != nil && !picked[i] {
+				sum.Skipped.Add(1)
 				continue
 			}
-			err = storage.NewEntry(im, itm.Name)
-			if err != nil {
-				log.Printf("in item %s: %v\n", itm.Name, err)
+			// the search reports downloads, so unpopular items cost no
+			// requests; sub-collections are still followed
+			if itm.Downloads < *minDownloads && itm.Mediatype != "collection" {
+				tasks.Skip(itm.Name, job.Collection, fmt.Sprintf("%d downloads, below -min-downloads", itm.Downloads))
+				sum.Skipped.Add(1)
+				continue
+			}
+			if denied.match(itm.Name) {
+				tasks.Skip(itm.Name, job.Collection, "denylisted")
+				sum.Skipped.Add(1)
+				continue
+			}
+			names = append(names, itm.Name)
+		}
+		if walk(names, fetch) {
+			// the page isn't checkpointed, so a resumed crawl starts over
+			// at its beginning
+			return
+		}
+		// the page may only be checkpointed once its items are stored
+		writer.Sync()
+		job.Indexed += sum.Indexed.Load() - indexedBefore
+		est.Observe(len(co.Resp.Buf), time.Since(pageStarted))
+		progress := job.Progress(batchSize)
+		omnihash.DefaultMetrics.SetProgress(progress)
+		if progress >= 0 {
+			infof("finished %s page %d (%.0f%% of %d items); %.2f requests/s allowed, %d sent in the last minute\n", job.Collection, job.Page, progress*100, job.Total, client.Limiter.Rate(), omnihash.DefaultMetrics.RequestsPerMinute())
+		} else {
+			infof("finished %s page %d; %.2f requests/s allowed, %d sent in the last minute\n", job.Collection, job.Page, client.Limiter.Rate(), omnihash.DefaultMetrics.RequestsPerMinute())
+		}
+		// numFound is taken from this page rather than job.Total, which
+		// never shrinks, so items removed mid-crawl don't cost an extra
+		// request for an empty page
+		if co.Last() {
+			finish(job, omnihash.DoneCompleted, sum)
+		} else {
+			tasks.Checkpoint(job)
+		}
+		estimate()
+	}
+}
+
+// sameFile reports whether paths a and b name the same file, including
+// through symlinks or hard links. Paths that don't exist yet are compared as
+// absolute paths.
+func sameFile(a, b string) bool {
+	ai, aerr := os.Stat(a)
+	bi, berr := os.Stat(b)
+	if aerr == nil && berr == nil {
+		return os.SameFile(ai, bi)
+	}
+	a, aerr = filepath.Abs(a)
+	b, berr = filepath.Abs(b)
+	return aerr == nil && berr == nil && a == b
+}
+
+// retryFailed fetches each item recorded as failed again, storing it with
+// writer and forgetting the failure if that works, or recording the new
+// failure if it doesn't. Sub-collections are queued for a later crawl.
+func retryFailed(ctx context.Context, client *omnihash.Client, tasks *omnihash.Tasks, writer *omnihash.Writer, intr <-chan os.Signal, timeUp <-chan time.Time) {
+	failed, err := tasks.FailedItems()
+	if err != nil {
+		log.Fatal(err)
+	}
+	infof("retrying %d failed items\n", len(failed))
+	var sum omnihash.Summary
+	var recovered, failing int
+	for _, f := range failed {
+		select {
+		case <-intr:
+			log.Println("interrupted; shutting down safely")
+			return
+		case <-timeUp:
+			log.Println("reached -max-duration; stopping")
+			return
+		default:
+		}
+		im, err := omnihash.NewItemMetadata(ctx, client, f.Name)
+		if errors.Is(err, omnihash.ErrRequestBudget) {
+			log.Printf("reached -max-requests (%d); stopping\n", client.MaxRequests)
+			break
+		}
+		omnihash.DefaultMetrics.ItemsProcessed.Add(1)
+		switch {
+		case errors.Is(err, omnihash.ErrNotModified):
+			// unchanged since it was stored, so nothing is missing
+		case err != nil:
+			log.Println(err)
+			tasks.Fail(f.Name, f.Collection, err)
+			failing++
+			continue
+		case im.IsCollection:
+			// how deep it was isn't known, so it's taken as a root
+			tasks.Add(f.Name, 1, 0)
+		default:
+			// only recovered once it's stored, or an item failing to
+			// store would be forgotten
+			err = writer.Store(ctx, f.Name, f.Collection, im, &sum)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil && !errors.Is(err, omnihash.ErrAlreadyStored) {
+				tasks.Fail(f.Name, f.Collection, err)
+				failing++
+				continue
+			}
+		}
+		err = tasks.Recovered(f.Name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		recovered++
+	}
+	log.Printf("recovered %d items, %d of them stored; %d still failing\n", recovered, sum.Indexed.Load(), failing)
+}
+
+// pauseOnSignal pauses and resumes l's requests as pauseSignal and
+// resumeSignal arrive. Requests already sent are left to finish. An interrupt
+// resumes them too, so a paused crawl can still shut down.
+func pauseOnSignal(l *omnihash.AdaptiveLimiter) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, pauseSignal, resumeSignal, os.Interrupt)
+	for sig := range sigs {
+		if sig == pauseSignal {
+			if l.Pause() {
+				log.Println("paused requests; send SIGUSR2 to resume")
 			}
+		} else if l.Resume() {
+			log.Println("resumed requests")
 		}
-		tasks.Increment(job.collection)
+	}
+}
+
+// drain waits for the workers to finish the items they are fetching, which
+// they have once done is closed, or gives up after timeout and cancels their
+// requests.
+func drain(done <-chan struct{}, inFlight *atomic.Int64, timeout time.Duration, cancel context.CancelFunc) {
+	log.Printf("waiting up to %v for %d items in flight\n", timeout, inFlight.Load())
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+		log.Printf("abandoning %d items still in flight\n", inFlight.Load())
+		cancel()
+		<-done
+	}
+}
+
+// notify posts a summary of the crawl to url. A failure is only logged,
+// since the crawl itself succeeded.
+func notify(url string, started time.Time) {
+	body, err := json.Marshal(struct {
+		ItemsProcessed int64   `json:"items_processed"`
+		ItemsFailed    int64   `json:"items_failed"`
+		HashesInserted int64   `json:"hashes_inserted"`
+		HTTPErrors     int64   `json:"http_errors"`
+		Seconds        float64 `json:"duration_seconds"`
+	}{
+		omnihash.DefaultMetrics.ItemsProcessed.Load(),
+		omnihash.DefaultMetrics.ItemsFailed.Load(),
+		omnihash.DefaultMetrics.HashesInserted.Load(),
+		omnihash.DefaultMetrics.HTTPErrors(),
+		time.Since(started).Seconds(),
+	})
+	if err != nil {
+		log.Printf("notifying %s: %v\n", url, err)
+		return
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("notifying %s: %v\n", url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("notifying %s: %s\n", url, resp.Status)
 	}
 }
@@ -0,0 +1,607 @@
+// Package omnihash crawls archive.org collections and indexes the hashes of
+// their files in SQLite.
+package omnihash
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Client makes requests to archive.org. Every field but the embedded
+// http.Client is optional.
+type Client struct {
+	http.Client
+	Limiter *AdaptiveLimiter
+	Breaker *Breaker
+	// if set, conditional requests are made with the validators saved here
+	Cache *ValidatorCache
+	// sent with every request
+	Headers http.Header
+	// archive.org S3-style credentials, as "accesskey:secret"; requests are
+	// anonymous if empty
+	Credentials string
+	// where requests are sent, such as a mirror or a test server;
+	// DefaultBaseURL if empty
+	BaseURL string
+	// if set, each item's _archive.torrent is fetched so its info-hash can
+	// be indexed as "btih"
+	Torrents bool
+	// if set, responses are asked for uncompressed, e.g. to read them in a
+	// packet capture
+	NoGzip bool
+	// if > 0, requests past this many fail with ErrRequestBudget
+	MaxRequests int64
+	// if > 0, how long an item's requests may take altogether, from when
+	// the first is sent, on top of the timeout of each; an item taking
+	// longer fails with ErrItemTimeout
+	ItemTimeout time.Duration
+
+	// metadata requests in flight, by item
+	items singleflight.Group
+	// sent, or refused for being over MaxRequests
+	requests atomic.Int64
+}
+
+// ErrRequestBudget is returned instead of sending a request once a client has
+// sent its MaxRequests.
+var ErrRequestBudget = errors.New("request budget spent")
+
+// BudgetSpent reports whether a request was refused for being over
+// MaxRequests.
+func (client *Client) BudgetSpent() bool {
+	return client.MaxRequests > 0 && client.requests.Load() > client.MaxRequests
+}
+
+const DefaultBaseURL = "https://archive.org"
+
+// escapePath escapes each segment of a slash-separated path, such as the name
+// of a file in a subdirectory of an item.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func (client *Client) url(path string) string {
+	if client.BaseURL == "" {
+		return DefaultBaseURL + path
+	}
+	return strings.TrimSuffix(client.BaseURL, "/") + path
+}
+
+// AskArchive requests page, returning the response and its decompressed
+// body, which the caller must close instead of resp.Body. If conditional is
+// set and client has a cache, ErrNotModified is returned when page hasn't
+// changed since it was last read.
+func AskArchive(ctx context.Context, client *Client, page string, conditional bool) (*http.Response, io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", page, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range client.Headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if client.NoGzip {
+		// without any accept-encoding, net/http would ask for gzip itself
+		req.Header.Set("accept-encoding", "identity")
+	} else {
+		req.Header.Set("accept-encoding", "gzip")
+	}
+	if client.Credentials != "" {
+		req.Header.Set("authorization", "LOW "+client.Credentials)
+	}
+	conditional = conditional && client.Cache != nil
+	if conditional {
+		etag, lastModified := client.Cache.Get(page)
+		if etag != "" {
+			req.Header.Add("if-none-match", etag)
+		}
+		if lastModified != "" {
+			req.Header.Add("if-modified-since", lastModified)
+		}
+	}
+	probe := false
+	if client.Breaker != nil {
+		probe, err = client.Breaker.Wait(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// for a probe that never hears back from archive.org
+	abandon := func() {
+		if probe {
+			client.Breaker.Abandon()
+		}
+	}
+	if client.Limiter != nil {
+		err = client.Limiter.Wait(ctx, req.URL.Host)
+		if err != nil {
+			abandon()
+			return nil, nil, err
+		}
+	}
+	if client.MaxRequests > 0 && client.requests.Add(1) > client.MaxRequests {
+		abandon()
+		return nil, nil, ErrRequestBudget
+	}
+	DefaultMetrics.Request()
+	startItemClock(ctx)
+	resp, err := client.Do(req)
+	if err != nil && ctx.Err() != nil {
+		// cancelled, which says nothing about archive.org
+		abandon()
+		return nil, nil, err
+	}
+	if client.Breaker != nil {
+		// only count failures that suggest archive.org is struggling, not
+		// ones like a missing item
+		client.Breaker.Record(err == nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests)
+	}
+	if err != nil {
+		DefaultMetrics.HTTPError("none")
+		return nil, nil, err
+	}
+	if client.Limiter != nil {
+		client.Limiter.Feedback(resp.StatusCode)
+	}
+	if resp.StatusCode >= 400 {
+		DefaultMetrics.HTTPError(fmt.Sprint(resp.StatusCode))
+	}
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return nil, nil, ErrNotModified
+	}
+	b := body{Reader: resp.Body, raw: resp.Body}
+	if resp.Header.Get("content-encoding") == "gzip" {
+		b.gz, err = gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, nil, err
+		}
+		b.Reader = b.gz
+	}
+	return resp, &b, nil
+}
+
+// at most this much of an unread body is drained so its connection can be
+// reused; past that, dropping the connection is cheaper
+const maxDrain = 64 << 10
+
+// body reads a response body through its decompressor, if any, and closes
+// both.
+type body struct {
+	io.Reader
+	gz  *gzip.Reader
+	raw io.ReadCloser
+}
+
+func (b *body) Close() error {
+	if b.gz != nil {
+		b.gz.Close()
+	}
+	io.Copy(io.Discard, io.LimitReader(b.raw, maxDrain))
+	return b.raw.Close()
+}
+
+// Errors that errors.Is finds in what requests return, to tell failures
+// apart without reading their messages. A StatusError is ErrNotFound or
+// ErrRateLimited depending on its status.
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrRateLimited = errors.New("rate limited")
+	// the response wasn't the JSON expected, such as a maintenance page
+	// or a body cut short
+	ErrDecode = errors.New("bad response")
+)
+
+// StatusError is returned for a response with an error status.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	// the start of the response body
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %s: %q", e.URL, e.Status, e.Body)
+}
+
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// Transient reports whether err, from a request, could well not happen if
+// the request were made again: the connection failed, the body was cut
+// short, or archive.org was overloaded or broken for a moment. An item that
+// doesn't exist, for one, isn't transient.
+func Transient(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrRateLimited) {
+		return true
+	}
+	var serr *StatusError
+	if errors.As(err, &serr) {
+		return serr.StatusCode >= 500
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func AskArchiveForJson(ctx context.Context, client *Client, page string, conditional bool, dst any) error {
+	_, err := askArchiveForJson(ctx, client, page, conditional, dst)
+	return err
+}
+
+// askArchiveForJson is AskArchiveForJson, also returning the response whose
+// body was decoded, for its headers.
+func askArchiveForJson(ctx context.Context, client *Client, page string, conditional bool, dst any) (*http.Response, error) {
+	resp, reader, err := AskArchive(ctx, client, page, conditional)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		snippet, _ := io.ReadAll(io.LimitReader(reader, 256))
+		reader.Close()
+		return nil, &StatusError{URL: page, StatusCode: resp.StatusCode, Status: resp.Status, Body: string(snippet)}
+	}
+	// archive.org sometimes answers with an HTML error or maintenance page,
+	// even with a 200, which would otherwise only show up as a confusing
+	// syntax error from the decoder
+	if ct := resp.Header.Get("content-type"); !strings.Contains(ct, "json") {
+		snippet, _ := io.ReadAll(io.LimitReader(reader, 256))
+		reader.Close()
+		return nil, fmt.Errorf("%s: %w: got %s instead of JSON (status %s): %q", page, ErrDecode, ct, resp.Status, snippet)
+	}
+	dec := json.NewDecoder(reader)
+	err = dec.Decode(&dst)
+	reader.Close()
+	if err != nil {
+		// e.g. a body cut short, which is worth retrying later
+		return nil, fmt.Errorf("%s: %w: %w", page, ErrDecode, err)
+	}
+	return resp, nil
+}
+
+type CollectionSubset struct {
+	Resp struct {
+		Count uint        `json:"numFound"`
+		Start uint        `json:"start"`
+		Buf   []SearchDoc `json:"docs"`
+	} `json:"response"`
+}
+
+// SearchDoc is an item found by a search.
+type SearchDoc struct {
+	Name      string `json:"identifier"`
+	Downloads int    `json:"downloads"`
+	Mediatype string `json:"mediatype"`
+	// every field returned, including any extra ones asked for, as JSON
+	Fields map[string]json.RawMessage `json:"-"`
+}
+
+func (d *SearchDoc) UnmarshalJSON(data []byte) error {
+	type plain SearchDoc
+	err := json.Unmarshal(data, (*plain)(d))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &d.Fields)
+}
+
+// NumFound returns how many items the whole search found.
+func (co *CollectionSubset) NumFound() int {
+	return int(co.Resp.Count)
+}
+
+// Start returns the position of this page's first item among them all.
+func (co *CollectionSubset) Start() int {
+	return int(co.Resp.Start)
+}
+
+// Last reports whether no items come after this page's.
+func (co *CollectionSubset) Last() bool {
+	return co.Start()+len(co.Resp.Buf) >= co.NumFound()
+}
+
+// NewCollectionSubset fetches a page of count items of the collection, most
+// downloaded first. Their identifiers, downloads, and mediatypes are always
+// returned; fields names any more to return, which are left in each
+// SearchDoc's Fields.
+func NewCollectionSubset(ctx context.Context, client *Client, collectionName string, count int, page int, fields ...string) (*CollectionSubset, error) {
+	if count < 1 || page < 1 {
+		return nil, fmt.Errorf("count (%d) and page (%d) must be >= 1", count, page)
+	}
+	var co CollectionSubset
+	query := url.Values{
+		// quoted, so a name with spaces or search syntax is matched as is
+		"q":      {`collection:"` + strings.ReplaceAll(collectionName, `"`, `\"`) + `"`},
+		"fl[]":   append([]string{"identifier", "downloads", "mediatype"}, fields...),
+		"rows":   {fmt.Sprint(count)},
+		"page":   {fmt.Sprint(page)},
+		"sort":   {"downloads desc"},
+		"output": {"json"},
+	}
+	err := AskArchiveForJson(ctx, client, client.url("/advancedsearch.php?"+query.Encode()), false, &co)
+	if err != nil {
+		return nil, err
+	}
+	return &co, nil
+}
+
+type File struct {
+	Name  string `json:"name"`
+	Sha1  string `json:"sha1"`
+	Md5   string `json:"md5"`
+	Crc32 string `json:"crc32"`
+	// archive.org's name for the format, e.g. "VBR MP3" or "Text PDF"
+	Format string `json:"format"`
+	// only listed for some newer items
+	Sha256 string `json:"sha256"`
+	// "original" if uploaded, "derivative" if archive.org made it from
+	// another file, or "metadata" if it describes the item
+	Source string `json:"source"`
+	// not listed by archive.org; set from the torrent itself when
+	// Client.Torrents is set
+	Btih string `json:"-"`
+}
+
+type fileHash struct {
+	algo string
+	hex  string
+}
+
+// Hashes returns every hash archive.org listed for the file, hex encoded and
+// labeled with the algorithm's name as stored in the database.
+func (f *File) Hashes() []fileHash {
+	var hashes []fileHash
+	for _, h := range []fileHash{{"sha1", f.Sha1}, {"md5", f.Md5}, {"crc32", f.Crc32}, {"sha256", f.Sha256}, {"btih", f.Btih}} {
+		if h.hex != "" {
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes
+}
+
+// withHashes returns a copy of f listing only hashes, which come from
+// f.Hashes.
+func (f File) withHashes(hashes []fileHash) File {
+	g := File{Name: f.Name, Format: f.Format, Source: f.Source}
+	for _, h := range hashes {
+		switch h.algo {
+		case "sha1":
+			g.Sha1 = h.hex
+		case "md5":
+			g.Md5 = h.hex
+		case "crc32":
+			g.Crc32 = h.hex
+		case "sha256":
+			g.Sha256 = h.hex
+		case "btih":
+			g.Btih = h.hex
+		}
+	}
+	return g
+}
+
+// ErrItemUnavailable is returned for an item that archive.org has no files
+// listing for, such as one that was removed or made dark.
+var ErrItemUnavailable = errors.New("item unavailable")
+
+// ErrItemTimeout is returned for an item that took longer than the
+// ItemTimeout of the client fetching it.
+var ErrItemTimeout = errors.New("item timed out")
+
+// itemClock cancels the requests of an item fetched with a Client.ItemTimeout
+// once it runs out. It only starts once the first request is sent, so an item
+// held back by the rate limiter or an open circuit breaker isn't failed for
+// it.
+type itemClock struct {
+	once    sync.Once
+	timeout time.Duration
+	cancel  context.CancelCauseFunc
+	timer   *time.Timer
+}
+
+type itemClockKey struct{}
+
+func withItemClock(ctx context.Context, timeout time.Duration) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	c := &itemClock{timeout: timeout, cancel: cancel}
+	return context.WithValue(ctx, itemClockKey{}, c), func() {
+		// the clock can't start after this
+		c.once.Do(func() {})
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		cancel(nil)
+	}
+}
+
+// startItemClock starts the clock of the item ctx is fetching, if it has one
+// and it isn't running yet.
+func startItemClock(ctx context.Context) {
+	c, _ := ctx.Value(itemClockKey{}).(*itemClock)
+	if c == nil {
+		return
+	}
+	c.once.Do(func() {
+		c.timer = time.AfterFunc(c.timeout, func() {
+			c.cancel(ErrItemTimeout)
+		})
+	})
+}
+
+type ItemMetadata struct {
+	Files        []File
+	IsCollection bool
+	// every collection the item belongs to, as its metadata lists them;
+	// not only the one it was found through
+	Collections []string
+	// the file listing as archive.org sent it, for StorageOptions.KeepListings
+	RawFiles json.RawMessage
+	// what to save in the client's ValidatorCache once the item is stored;
+	// saving them sooner would skip an item whose write failed as
+	// unchanged
+	Validators Validators
+}
+
+// stringList is a metadata field archive.org gives as a string when it has
+// one value and as an array when it has several.
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*l = stringList{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// NewItemMetadata fetches the metadata of item. Concurrent calls for the same
+// item share one set of requests; the result must not be modified.
+func NewItemMetadata(ctx context.Context, client *Client, item string) (*ItemMetadata, error) {
+	for {
+		ch := client.items.DoChan(item, func() (any, error) {
+			if client.ItemTimeout <= 0 {
+				return newItemMetadata(ctx, client, item)
+			}
+			ictx, stop := withItemClock(ctx, client.ItemTimeout)
+			defer stop()
+			im, err := newItemMetadata(ictx, client, item)
+			// the caller's own deadline isn't the item's fault
+			if err != nil && context.Cause(ictx) == ErrItemTimeout {
+				return nil, fmt.Errorf("%w: %s took over %v", ErrItemTimeout, item, client.ItemTimeout)
+			}
+			return im, err
+		})
+		select {
+		case r := <-ch:
+			if errors.Is(r.Err, context.Canceled) && ctx.Err() == nil {
+				// the requests were made with the context of another
+				// caller, who gave up on them
+				continue
+			}
+			im, _ := r.Val.(*ItemMetadata)
+			return im, r.Err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func newItemMetadata(ctx context.Context, client *Client, item string) (*ItemMetadata, error) {
+	var im ItemMetadata
+	// one request gives both the metadata and the file listing; only the
+	// fields needed are decoded. It's conditional as a whole, so an item
+	// whose metadata changed is fetched again even if its files didn't
+	var full struct {
+		Files    json.RawMessage `json:"files"`
+		Metadata struct {
+			Mediatype  string     `json:"mediatype"`
+			Collection stringList `json:"collection"`
+		} `json:"metadata"`
+		Error string `json:"error"`
+	}
+	page := client.url("/metadata/" + url.PathEscape(item))
+	resp, err := askArchiveForJson(ctx, client, page, true, &full)
+	if err != nil {
+		return nil, err
+	}
+	if client.Cache != nil {
+		im.Validators = Validators{URL: page, ETag: resp.Header.Get("etag"), LastModified: resp.Header.Get("last-modified")}
+	}
+	// a missing or dark item is answered with an error, or with nothing
+	// at all, rather than an empty listing
+	if full.Error != "" {
+		return nil, fmt.Errorf("item %s: %w: %s", item, ErrItemUnavailable, full.Error)
+	}
+	im.IsCollection = full.Metadata.Mediatype == "collection"
+	// sorted, and without the repeats metadata sometimes has
+	slices.Sort(full.Metadata.Collection)
+	im.Collections = slices.Compact(full.Metadata.Collection)
+	if im.IsCollection {
+		// its own files, such as its logo, are kept for a crawl that
+		// stores them, but a bad listing mustn't keep its items from
+		// being crawled
+		if json.Unmarshal(full.Files, &im.Files) == nil {
+			im.RawFiles = full.Files
+		} else {
+			im.Files = nil
+		}
+		return &im, nil
+	}
+	if full.Files == nil || string(full.Files) == "null" {
+		return nil, fmt.Errorf("item %s: %w: no file listing", item, ErrItemUnavailable)
+	}
+	err = json.Unmarshal(full.Files, &im.Files)
+	if err != nil {
+		return nil, fmt.Errorf("item %s: %w: files: %w", item, ErrDecode, err)
+	}
+	im.RawFiles = full.Files
+	if client.Torrents {
+		for i := range im.Files {
+			f := &im.Files[i]
+			if f.Name != item+"_archive.torrent" {
+				continue
+			}
+			// the rest of the item is still worth indexing without it
+			f.Btih, err = fetchInfoHash(ctx, client, item, f.Name)
+			if err != nil {
+				log.Printf("item %s: %v\n", item, err)
+			}
+		}
+	}
+	return &im, nil
+}
+
+// torrents larger than this aren't read
+const maxTorrentSize = 32 << 20
+
+func fetchInfoHash(ctx context.Context, client *Client, item string, name string) (string, error) {
+	page := client.url("/download/" + url.PathEscape(item) + "/" + escapePath(name))
+	resp, reader, err := AskArchive(ctx, client, page, false)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", page, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, maxTorrentSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxTorrentSize {
+		return "", fmt.Errorf("%s: torrent is over %d bytes", page, maxTorrentSize)
+	}
+	return InfoHash(data)
+}
@@ -0,0 +1,328 @@
+package omnihash
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testSha1 = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	testMd5  = "d41d8cd98f00b204e9800998ecf8427e"
+)
+
+// mockArchive serves canned archive.org responses: a search over three items
+// and the metadata of a few items that each take one of the paths a real
+// response can.
+type mockArchive struct {
+	*httptest.Server
+	mu sync.Mutex
+	// the request URIs received, as sent
+	requests []string
+	// how many responses were gzipped
+	gzipped int
+}
+
+func newMockArchive(t *testing.T) *mockArchive {
+	m := &mockArchive{}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.serve))
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockArchive) client() *Client {
+	return &Client{BaseURL: m.URL}
+}
+
+// received returns the request URIs received so far.
+func (m *mockArchive) received() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.requests...)
+}
+
+func (m *mockArchive) serve(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	m.requests = append(m.requests, r.RequestURI)
+	m.mu.Unlock()
+
+	gz := strings.Contains(r.Header.Get("accept-encoding"), "gzip")
+	send := func(status int, contentType string, body any) {
+		var b []byte
+		switch body := body.(type) {
+		case string:
+			b = []byte(body)
+		default:
+			b, _ = json.Marshal(body)
+		}
+		w.Header().Set("content-type", contentType)
+		if gz {
+			w.Header().Set("content-encoding", "gzip")
+		}
+		w.WriteHeader(status)
+		if !gz {
+			w.Write(b)
+			return
+		}
+		m.mu.Lock()
+		m.gzipped++
+		m.mu.Unlock()
+		zw := gzip.NewWriter(w)
+		zw.Write(b)
+		zw.Close()
+	}
+
+	if r.URL.Path == "/advancedsearch.php" {
+		q := r.URL.Query()
+		rows, _ := strconv.Atoi(q.Get("rows"))
+		page, _ := strconv.Atoi(q.Get("page"))
+		const total = 3
+		var docs []map[string]any
+		start := (page - 1) * rows
+		for i := start; i < min(start+rows, total); i++ {
+			docs = append(docs, map[string]any{"identifier": fmt.Sprintf("item%d", i), "downloads": 10 - i})
+		}
+		send(http.StatusOK, "application/json", map[string]any{
+			"response": map[string]any{"numFound": total, "start": start, "docs": docs},
+		})
+		return
+	}
+
+	item, ok := strings.CutPrefix(r.URL.Path, "/metadata/")
+	if !ok {
+		send(http.StatusNotFound, "text/plain", "no such page")
+		return
+	}
+	switch item {
+	case "maintenance":
+		send(http.StatusOK, "text/html", "<html>down for maintenance</html>")
+	case "ratelimited":
+		send(http.StatusTooManyRequests, "application/json", `{"error":"slow down"}`)
+	case "missing":
+		send(http.StatusNotFound, "application/json", `{}`)
+	case "truncated", "truncatedheader":
+		// gzipped, but cut off partway through the stream or its header
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		fmt.Fprintf(zw, `{"metadata":{"mediatype":"texts"},"files":[{"name":"a.txt","sha1":"%s"}]}`, testSha1)
+		zw.Close()
+		n := buf.Len() / 2
+		if item == "truncatedheader" {
+			n = 4
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("content-encoding", "gzip")
+		w.Write(buf.Bytes()[:n])
+	case "shorthash":
+		send(http.StatusOK, "application/json", map[string]any{
+			"metadata": map[string]any{"mediatype": "texts", "collection": "coll"},
+			"files":    []map[string]string{{"name": "a.txt", "sha1": "da39a3"}},
+		})
+	default:
+		send(http.StatusOK, "application/json", map[string]any{
+			"metadata": map[string]any{"mediatype": "texts", "collection": []string{"coll", "other", "coll"}},
+			"files":    []map[string]string{{"name": "a.txt", "sha1": testSha1, "md5": testMd5, "source": "original"}},
+		})
+	}
+}
+
+func TestNewCollectionSubset(t *testing.T) {
+	m := newMockArchive(t)
+	client := m.client()
+
+	co, err := NewCollectionSubset(context.Background(), client, "coll", 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if co.NumFound() != 3 || len(co.Resp.Buf) != 2 || co.Last() {
+		t.Fatalf("page 1: got %d of %d items, last %v; want 2 of 3, not last", len(co.Resp.Buf), co.NumFound(), co.Last())
+	}
+	if co.Resp.Buf[0].Name != "item0" || co.Resp.Buf[0].Downloads != 10 {
+		t.Errorf("page 1: first item is %+v", co.Resp.Buf[0])
+	}
+
+	co, err = NewCollectionSubset(context.Background(), client, "coll", 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(co.Resp.Buf) != 1 || co.Start() != 2 || !co.Last() {
+		t.Fatalf("page 2: got %d items from %d, last %v; want 1 from 2, last", len(co.Resp.Buf), co.Start(), co.Last())
+	}
+
+	_, err = NewCollectionSubset(context.Background(), client, "coll", 0, 1)
+	if err == nil {
+		t.Error("a count of 0 was accepted")
+	}
+}
+
+func TestNewItemMetadata(t *testing.T) {
+	for _, noGzip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("no gzip %v", noGzip), func(t *testing.T) {
+			m := newMockArchive(t)
+			client := m.client()
+			client.NoGzip = noGzip
+
+			im, err := NewItemMetadata(context.Background(), client, "item0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if im.IsCollection {
+				t.Error("a texts item was taken for a collection")
+			}
+			if strings.Join(im.Collections, ",") != "coll,other" {
+				t.Errorf("got collections %q, want coll and other once each", im.Collections)
+			}
+			if len(im.Files) != 1 || im.Files[0].Sha1 != testSha1 || im.Files[0].Md5 != testMd5 {
+				t.Fatalf("got files %+v", im.Files)
+			}
+			if im.RawFiles == nil {
+				t.Error("the raw file listing wasn't kept")
+			}
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if (m.gzipped > 0) == noGzip {
+				t.Errorf("%d responses were gzipped", m.gzipped)
+			}
+		})
+	}
+}
+
+func TestAskArchiveForJsonNotJSON(t *testing.T) {
+	m := newMockArchive(t)
+	client := m.client()
+
+	var dst any
+	err := AskArchiveForJson(context.Background(), client, client.url("/metadata/maintenance"), false, &dst)
+	if !errors.Is(err, ErrDecode) {
+		t.Fatalf("got %v, want ErrDecode", err)
+	}
+	if !strings.Contains(err.Error(), "text/html") || !strings.Contains(err.Error(), "down for maintenance") {
+		t.Errorf("%q doesn't say what was received instead", err)
+	}
+}
+
+func TestAskArchiveForJsonStatus(t *testing.T) {
+	m := newMockArchive(t)
+	client := m.client()
+
+	for _, tc := range []struct {
+		item      string
+		status    int
+		is        error
+		transient bool
+	}{
+		{"ratelimited", http.StatusTooManyRequests, ErrRateLimited, true},
+		{"missing", http.StatusNotFound, ErrNotFound, false},
+	} {
+		var dst any
+		err := AskArchiveForJson(context.Background(), client, client.url("/metadata/"+tc.item), false, &dst)
+		var serr *StatusError
+		if !errors.As(err, &serr) {
+			t.Errorf("%s: got %v, want a StatusError", tc.item, err)
+			continue
+		}
+		if serr.StatusCode != tc.status {
+			t.Errorf("%s: got status %d, want %d", tc.item, serr.StatusCode, tc.status)
+		}
+		if !errors.Is(err, tc.is) {
+			t.Errorf("%s: %v isn't %v", tc.item, err, tc.is)
+		}
+		if Transient(err) != tc.transient {
+			t.Errorf("%s: transient is %v, want %v", tc.item, Transient(err), tc.transient)
+		}
+	}
+
+	_, err := NewItemMetadata(context.Background(), client, "ratelimited")
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("NewItemMetadata: got %v, want ErrRateLimited", err)
+	}
+}
+
+func TestEscapedNames(t *testing.T) {
+	m := newMockArchive(t)
+	client := m.client()
+	const name = "a b&c"
+
+	_, err := NewCollectionSubset(context.Background(), client, name, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewItemMetadata(context.Background(), client, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := m.received()
+	if len(got) != 2 {
+		t.Fatalf("got requests %q, want 2", got)
+	}
+	search, err := url.ParseRequestURI(got[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := search.Query()
+	if q := query.Get("q"); q != `collection:"a b&c"` {
+		t.Errorf("got q %q from %s", q, got[0])
+	}
+	if query.Has(`c"`) {
+		t.Errorf("the ampersand split the query: %s", got[0])
+	}
+	if got[1] != "/metadata/a%20b&c" {
+		t.Errorf("got metadata request %s, want /metadata/a%%20b&c", got[1])
+	}
+}
+
+func TestTruncatedGzip(t *testing.T) {
+	m := newMockArchive(t)
+	client := m.client()
+
+	for _, item := range []string{"truncated", "truncatedheader"} {
+		_, err := NewItemMetadata(context.Background(), client, item)
+		if err == nil {
+			t.Errorf("%s: a truncated body was accepted", item)
+			continue
+		}
+		if !errors.Is(err, io.ErrUnexpectedEOF) || !Transient(err) {
+			t.Errorf("%s: got %v, want a transient unexpected EOF", item, err)
+		}
+	}
+
+	// and the client still works afterwards
+	_, err := NewItemMetadata(context.Background(), client, "item0")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHashFromHexShort(t *testing.T) {
+	_, err := HashFromHex("sha1", "da39a3")
+	if err == nil {
+		t.Fatal("a short sha1 was accepted")
+	}
+	hash, err := HashFromHex("sha1", strings.ToUpper(testSha1))
+	if err != nil || len(hash) != 20 {
+		t.Fatalf("got %x, %v for a valid sha1", hash, err)
+	}
+
+	// an item whose only hash is short has nothing to store
+	m := newMockArchive(t)
+	im, err := NewItemMetadata(context.Background(), m.client(), "shorthash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = decodeEntry(im, "shorthash", false)
+	if err != errNoValidFiles {
+		t.Errorf("got %v, want errNoValidFiles", err)
+	}
+}
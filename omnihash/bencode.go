@@ -0,0 +1,97 @@
+package omnihash
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"strconv"
+)
+
+// InfoHash returns the hex encoded BitTorrent info-hash of the torrent file
+// data: the SHA-1 of its bencoded info dictionary, exactly as it appears.
+func InfoHash(data []byte) (string, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return "", fmt.Errorf("torrent is not a bencoded dictionary")
+	}
+	i := 1
+	for i < len(data) && data[i] != 'e' {
+		key, end, err := bencodeString(data, i)
+		if err != nil {
+			return "", err
+		}
+		start := end
+		end, err = skipBencode(data, start, 0)
+		if err != nil {
+			return "", err
+		}
+		if string(key) == "info" {
+			if data[start] != 'd' {
+				return "", fmt.Errorf("torrent info is not a dictionary")
+			}
+			sum := sha1.Sum(data[start:end])
+			return HashToHex(sum[:]), nil
+		}
+		i = end
+	}
+	return "", fmt.Errorf("torrent has no info dictionary")
+}
+
+// deeper nesting than this is taken to be garbage rather than a torrent
+const maxBencodeDepth = 64
+
+// skipBencode returns the index just past the value starting at data[i].
+func skipBencode(data []byte, i int, depth int) (int, error) {
+	if i >= len(data) {
+		return 0, fmt.Errorf("truncated bencode")
+	}
+	if depth > maxBencodeDepth {
+		return 0, fmt.Errorf("bencode nested too deeply")
+	}
+	switch c := data[i]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[i:], 'e')
+		if end < 0 {
+			return 0, fmt.Errorf("unterminated bencode integer at %d", i)
+		}
+		return i + end + 1, nil
+	case c == 'l' || c == 'd':
+		i++
+		for i < len(data) && data[i] != 'e' {
+			var err error
+			if c == 'd' {
+				_, i, err = bencodeString(data, i)
+				if err != nil {
+					return 0, err
+				}
+			}
+			i, err = skipBencode(data, i, depth+1)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if i >= len(data) {
+			return 0, fmt.Errorf("truncated bencode")
+		}
+		return i + 1, nil
+	case c >= '0' && c <= '9':
+		_, end, err := bencodeString(data, i)
+		return end, err
+	default:
+		return 0, fmt.Errorf("unexpected %q in bencode at %d", c, i)
+	}
+}
+
+// bencodeString reads the string starting at data[i], returning it and the
+// index just past it.
+func bencodeString(data []byte, i int) ([]byte, int, error) {
+	colon := bytes.IndexByte(data[i:], ':')
+	if colon < 0 {
+		return nil, 0, fmt.Errorf("bad bencode string at %d", i)
+	}
+	n, err := strconv.Atoi(string(data[i : i+colon]))
+	start := i + colon + 1
+	if err != nil || n < 0 || n > len(data)-start {
+		return nil, 0, fmt.Errorf("bad bencode string length at %d", i)
+	}
+	return data[start : start+n], start + n, nil
+}
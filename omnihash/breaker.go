@@ -0,0 +1,105 @@
+package omnihash
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// Breaker stops all requests for a cooldown period once threshold requests
+// in a row have failed, then lets a single request through to probe whether
+// archive.org has recovered. If the probe fails, it waits out another
+// cooldown.
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     int
+	openedAt  time.Time
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (b *Breaker) setState(state int) {
+	b.state = state
+	DefaultMetrics.BreakerState.Store(int64(state))
+}
+
+// Wait blocks until a request may be sent, or ctx is done. It reports
+// whether the caller is the probe, which must either Record how its request
+// went or, if it never learns, Abandon it, or every other request would wait
+// on it forever.
+func (b *Breaker) Wait(ctx context.Context) (probe bool, err error) {
+	for {
+		b.mu.Lock()
+		var wait time.Duration
+		switch b.state {
+		case breakerClosed:
+			b.mu.Unlock()
+			return false, nil
+		case breakerOpen:
+			wait = time.Until(b.openedAt.Add(b.cooldown))
+			if wait <= 0 {
+				// the caller becomes the probe
+				b.setState(breakerHalfOpen)
+				log.Println("circuit breaker half open; probing archive.org")
+				b.mu.Unlock()
+				return true, nil
+			}
+		case breakerHalfOpen:
+			// wait for the probe to finish
+			wait = time.Second
+		}
+		b.mu.Unlock()
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return false, ctx.Err()
+		}
+	}
+}
+
+// Abandon gives up the probe of a request that wasn't sent, or was cancelled
+// before it said anything about archive.org, so the next request probes
+// instead.
+func (b *Breaker) Abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		// the cooldown is already over
+		b.openedAt = time.Now().Add(-b.cooldown)
+		b.setState(breakerOpen)
+	}
+}
+
+// Record notes whether a request succeeded.
+func (b *Breaker) Record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		if b.state != breakerClosed {
+			log.Println("circuit breaker closed; archive.org is responding again")
+		}
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		log.Printf("circuit breaker open after %d failed requests; pausing for %v\n", b.failures, b.cooldown)
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
@@ -0,0 +1,90 @@
+package omnihash
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+)
+
+// returned instead of a response when a conditional request finds the
+// resource unchanged since the last crawl
+var ErrNotModified = errors.New("not modified since last crawl")
+
+// ValidatorCache remembers the ETag and Last-Modified headers archive.org
+// sent for each URL, so a re-crawl can ask for only what has changed.
+type ValidatorCache struct {
+	db  *sql.DB
+	get *sql.Stmt
+	put *sql.Stmt
+}
+
+func NewValidatorCache(dbPath string) (*ValidatorCache, error) {
+	var c ValidatorCache
+	var err error
+
+	c.db, err = openSQLite(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.db.Exec(`CREATE TABLE IF NOT EXISTS validators (
+url TEXT PRIMARY KEY,
+etag TEXT,
+last_modified TEXT
+);`)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	c.get, err = c.db.Prepare(`SELECT etag, last_modified FROM validators WHERE url = (?);`)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.put, err = c.db.Prepare(`INSERT INTO validators (url, etag, last_modified) VALUES (?, ?, ?)
+ON CONFLICT (url) DO UPDATE SET etag = excluded.etag, last_modified = excluded.last_modified;`)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (c *ValidatorCache) Get(url string) (etag, lastModified string) {
+	err := c.get.QueryRow(url).Scan(&etag, &lastModified)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("looking up validators for %s: %v\n", url, err)
+	}
+	return
+}
+
+// Validators are the ETag and Last-Modified headers a URL was answered with.
+type Validators struct {
+	URL          string
+	ETag         string
+	LastModified string
+}
+
+func (c *ValidatorCache) Put(url, etag, lastModified string) {
+	if etag == "" && lastModified == "" {
+		return
+	}
+	_, err := c.put.Exec(url, etag, lastModified)
+	if err != nil {
+		log.Printf("saving validators for %s: %v\n", url, err)
+	}
+}
+
+func (c *ValidatorCache) Close() {
+	if c.get != nil {
+		c.get.Close()
+	}
+	if c.put != nil {
+		c.put.Close()
+	}
+	if c.db != nil {
+		c.db.Close()
+	}
+}
@@ -0,0 +1,56 @@
+package omnihash
+
+import (
+	"context"
+	"net/url"
+)
+
+// DefaultChangesURL is archive.org's feed of recently changed items.
+const DefaultChangesURL = "https://be-api.us.archive.org/changes/v1"
+
+// Changes is a batch of the changes feed.
+type Changes struct {
+	Changes []struct {
+		Identifier string `json:"identifier"`
+	} `json:"changes"`
+	// where the next batch starts
+	NextToken string `json:"next_token"`
+	// roughly how many changes come after this batch
+	Distance int64 `json:"estimated_distance_from_head"`
+	// set once the feed is caught up, when it's worth waiting before asking
+	// again
+	Sleep bool `json:"do_sleep_before_returning"`
+}
+
+// Identifiers returns the items changed in the batch, in the order they
+// changed. An item changed several times is only listed once.
+func (ch *Changes) Identifiers() []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, c := range ch.Changes {
+		if c.Identifier == "" || seen[c.Identifier] {
+			continue
+		}
+		seen[c.Identifier] = true
+		ids = append(ids, c.Identifier)
+	}
+	return ids
+}
+
+// NewChanges fetches the batch of the changes feed at feedURL that starts at
+// token, or, if token is empty, at the start of startDate, given as
+// YYYYMMDD.
+func NewChanges(ctx context.Context, client *Client, feedURL, token, startDate string) (*Changes, error) {
+	query := url.Values{}
+	if token != "" {
+		query.Set("token", token)
+	} else {
+		query.Set("start_date", startDate)
+	}
+	var ch Changes
+	err := AskArchiveForJson(ctx, client, feedURL+"?"+query.Encode(), false, &ch)
+	if err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
@@ -0,0 +1,122 @@
+package omnihash
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// the tables and indexes NewStorage makes
+var (
+	checkTables  = []string{"archive_items", "files", "file_hashes", "item_collections"}
+	checkIndexes = []string{"idx_algo_hash", "idx_file_item", "idx_collection_item"}
+)
+
+// CheckReport is what Check found in one database file.
+type CheckReport struct {
+	Path string
+	// what PRAGMA integrity_check reported, or nothing if all is well
+	Integrity []string
+	// tables and indexes that should be there but aren't
+	Missing []string
+	// by table
+	Rows map[string]int64
+	// rows whose foreign key points at nothing, by table
+	Orphans map[string]int64
+}
+
+// OK reports whether nothing is wrong. Missing tables and indexes count, as
+// they only go missing if the file was changed by hand or is damaged.
+func (r *CheckReport) OK() bool {
+	return len(r.Integrity) == 0 && len(r.Missing) == 0 && len(r.Orphans) == 0
+}
+
+// Check looks for corruption and rows left dangling, such as after a crash,
+// reporting on each file of a sharded database separately. It doesn't change
+// anything.
+func (s *Storage) Check() ([]CheckReport, error) {
+	if s.shards != nil {
+		var reports []CheckReport
+		for _, shard := range s.shards {
+			r, err := shard.Check()
+			reports = append(reports, r...)
+			if err != nil {
+				return reports, err
+			}
+		}
+		return reports, nil
+	}
+	r := CheckReport{Path: s.path, Rows: make(map[string]int64), Orphans: make(map[string]int64)}
+	err := s.checkIntegrity(&r)
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range checkTables {
+		ok, err := s.hasSchema("table", table)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			r.Missing = append(r.Missing, "table "+table)
+			continue
+		}
+		var n int64
+		err = s.db.QueryRow(`SELECT COUNT(*) FROM ` + table + `;`).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		r.Rows[table] = n
+	}
+	for _, index := range checkIndexes {
+		ok, err := s.hasSchema("index", index)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			r.Missing = append(r.Missing, "index "+index)
+		}
+	}
+	rows, err := s.db.Query(`PRAGMA foreign_key_check;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		var fkid int64
+		err = rows.Scan(&table, &rowid, &parent, &fkid)
+		if err != nil {
+			return nil, err
+		}
+		r.Orphans[table]++
+	}
+	return []CheckReport{r}, rows.Err()
+}
+
+func (s *Storage) checkIntegrity(r *CheckReport) error {
+	rows, err := s.db.Query(`PRAGMA integrity_check;`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var msg string
+		err = rows.Scan(&msg)
+		if err != nil {
+			return err
+		}
+		if msg != "ok" {
+			r.Integrity = append(r.Integrity, msg)
+		}
+	}
+	return rows.Err()
+}
+
+func (s *Storage) hasSchema(kind, name string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = (?) AND name = (?);`, kind, name).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("looking for %s %s: %w", kind, name, err)
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,270 @@
+package omnihash
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TaskQueue is what a crawl needs of its queue of collections. Tasks keeps it
+// in SQLite, and FileTasks in a JSON file.
+type TaskQueue interface {
+	Len() (int, error)
+	Remaining(pageSize int) (items int64, unknown int, err error)
+	Next() (*Job, bool, error)
+	Checkpoint(job *Job)
+	Add(name string, page, depth int)
+	Remove(job *Job, status DoneStatus, reason string, sum *Summary)
+	Fail(name, collection string, cause error)
+	Skip(name, collection, reason string)
+	Close()
+}
+
+// how many calls to FileTasks.Checkpoint or Remove go by between saves
+const checkpointEvery = 5
+
+type checkpointJob struct {
+	Page    int    `json:"page"`
+	Cursor  string `json:"cursor,omitempty"`
+	Total   int    `json:"total,omitempty"`
+	Depth   int    `json:"depth,omitempty"`
+	Indexed int64  `json:"indexed,omitempty"`
+}
+
+type checkpointDone struct {
+	Page       int        `json:"page"`
+	Status     DoneStatus `json:"status"`
+	Reason     string     `json:"reason,omitempty"`
+	Indexed    int64      `json:"indexed"`
+	Skipped    int64      `json:"skipped"`
+	Failed     int64      `json:"failed"`
+	FinishedAt int64      `json:"finished_at"`
+}
+
+type checkpointFailure struct {
+	Collection string `json:"collection"`
+	Error      string `json:"error"`
+	Kind       string `json:"kind"`
+	FailedAt   int64  `json:"failed_at"`
+}
+
+type checkpointState struct {
+	Jobs   map[string]checkpointJob     `json:"jobs"`
+	Done   map[string]checkpointDone    `json:"done"`
+	Failed map[string]checkpointFailure `json:"failed"`
+}
+
+// FileTasks is a TaskQueue kept in memory and saved as JSON to a single
+// file, every few pages and when it is closed. The file is replaced
+// atomically, so a crash leaves the last save intact; the pages crawled since
+// are crawled again. Skipped items aren't recorded, as there can be far too
+// many to rewrite each time.
+type FileTasks struct {
+	path  string
+	mu    sync.Mutex
+	state checkpointState
+	// changes since the last save
+	unsaved int
+	// as in Tasks
+	opts    TasksOptions
+	visited map[string]int
+}
+
+// NewFileTasks loads the checkpoint at path, or starts an empty one if there
+// is no file there yet. Of opts, only MaxDepth applies.
+func NewFileTasks(path string, opts TasksOptions) (*FileTasks, error) {
+	t := FileTasks{path: path, opts: opts, visited: make(map[string]int)}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &t.state)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.state.Jobs == nil {
+		t.state.Jobs = make(map[string]checkpointJob)
+	}
+	if t.state.Done == nil {
+		t.state.Done = make(map[string]checkpointDone)
+	}
+	if t.state.Failed == nil {
+		t.state.Failed = make(map[string]checkpointFailure)
+	}
+	return &t, nil
+}
+
+// save writes the state to a temporary file and renames it over the
+// checkpoint. t.mu must be held.
+func (t *FileTasks) save() error {
+	data, err := json.MarshalIndent(&t.state, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, t.path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	t.unsaved = 0
+	return nil
+}
+
+// changed counts a change, saving once there have been checkpointEvery of
+// them. t.mu must be held.
+func (t *FileTasks) changed() {
+	t.unsaved++
+	if t.unsaved < checkpointEvery {
+		return
+	}
+	err := t.save()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (t *FileTasks) Len() (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.state.Jobs), nil
+}
+
+// Remaining is as Tasks.Remaining.
+func (t *FileTasks) Remaining(pageSize int) (items int64, unknown int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, j := range t.state.Jobs {
+		if j.Total == 0 {
+			unknown++
+			continue
+		}
+		items += int64(max(j.Total-(j.Page-1)*pageSize, 0))
+	}
+	return items, unknown, nil
+}
+
+// Next returns the job with the lowest page, or false if the queue is empty.
+func (t *FileTasks) Next() (*Job, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.state.Jobs) == 0 {
+		return nil, false, nil
+	}
+	names := make([]string, 0, len(t.state.Jobs))
+	for name := range t.state.Jobs {
+		names = append(names, name)
+	}
+	// by name among equal pages, so the order doesn't change between runs
+	sort.Strings(names)
+	var job *Job
+	for _, name := range names {
+		j := t.state.Jobs[name]
+		if job == nil || j.Page < job.Page {
+			job = &Job{Collection: name, Page: j.Page, Cursor: j.Cursor, Total: j.Total, Depth: j.Depth, Indexed: j.Indexed}
+		}
+	}
+	if _, ok := t.visited[job.Collection]; !ok {
+		t.visited[job.Collection] = job.Depth
+	}
+	return job, true, nil
+}
+
+// Checkpoint is as Tasks.Checkpoint, but only every few calls are saved.
+func (t *FileTasks) Checkpoint(job *Job) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j, ok := t.state.Jobs[job.Collection]
+	if !ok {
+		return
+	}
+	j.Page = job.Page + 1
+	j.Cursor = job.Cursor
+	j.Total = max(j.Total, job.Total)
+	j.Indexed = job.Indexed
+	t.state.Jobs[job.Collection] = j
+	t.changed()
+}
+
+// Add is as Tasks.Add. It isn't saved until the next save a Checkpoint or
+// Remove makes, so that a whole page of sub-collections is saved at once.
+func (t *FileTasks) Add(name string, page, depth int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.visited[name]; ok {
+		return
+	}
+	if depth > t.opts.MaxDepth {
+		log.Printf("not queueing %s: deeper than %d nested collections\n", name, t.opts.MaxDepth)
+		return
+	}
+	t.visited[name] = depth
+	if _, ok := t.state.Done[name]; ok {
+		return
+	}
+	if _, ok := t.state.Jobs[name]; !ok {
+		t.state.Jobs[name] = checkpointJob{Page: page, Depth: depth}
+	}
+}
+
+// Remove is as Tasks.Remove.
+func (t *FileTasks) Remove(job *Job, status DoneStatus, reason string, sum *Summary) {
+	if sum == nil {
+		sum = &Summary{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.state.Jobs, job.Collection)
+	t.state.Done[job.Collection] = checkpointDone{
+		Page:       job.Page,
+		Status:     status,
+		Reason:     reason,
+		Indexed:    sum.Indexed.Load(),
+		Skipped:    sum.Skipped.Load(),
+		Failed:     sum.Failed.Load(),
+		FinishedAt: time.Now().Unix(),
+	}
+	t.changed()
+}
+
+// Fail is as Tasks.Fail.
+func (t *FileTasks) Fail(name, collection string, cause error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.state.Failed[name] = checkpointFailure{Collection: collection, Error: cause.Error(), Kind: FailureKind(cause), FailedAt: time.Now().Unix()}
+}
+
+// Skip does nothing; skipped items aren't recorded in a checkpoint file.
+func (t *FileTasks) Skip(name, collection, reason string) {}
+
+// Close saves the checkpoint.
+func (t *FileTasks) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.save()
+	if err != nil {
+		log.Printf("failed to save %s: %v\n", t.path, err)
+	}
+}
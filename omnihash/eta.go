@@ -0,0 +1,39 @@
+package omnihash
+
+import "time"
+
+// how much each page's rate counts against those before it in Estimator
+const etaSmoothing = 0.3
+
+// Estimator estimates how long the rest of a crawl takes from how fast its
+// pages have been walked, smoothed so that one slow or fast page doesn't
+// swing it, but a lasting change in rate soon shows.
+type Estimator struct {
+	rate float64 // items per second; 0 until a page has been timed
+}
+
+// Observe records that a page of n items took d.
+func (e *Estimator) Observe(n int, d time.Duration) {
+	if n <= 0 || d <= 0 {
+		return
+	}
+	rate := float64(n) / d.Seconds()
+	if e.rate == 0 {
+		e.rate = rate
+	} else {
+		e.rate += etaSmoothing * (rate - e.rate)
+	}
+}
+
+// ETA returns how long items take at the observed rate, or at fallback items
+// per second if no page has been timed yet, or false if neither is known.
+func (e *Estimator) ETA(items int64, fallback float64) (time.Duration, bool) {
+	rate := e.rate
+	if rate == 0 {
+		rate = fallback
+	}
+	if rate <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(items) / rate * float64(time.Second)), true
+}
@@ -0,0 +1,116 @@
+package omnihash
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// how many hex digits a hash of each algorithm has
+var hexLengths = map[string]int{
+	"sha1":   40,
+	"md5":    32,
+	"crc32":  8,
+	"sha256": 64,
+	"btih":   40,
+}
+
+// HashFromHex decodes a hash of algo written in hex, as archive.org lists it
+// or a user types it. Surrounding space and case are ignored, since
+// archive.org occasionally pads hashes or uppercases them, but the hash must
+// have the right number of digits for algo.
+func HashFromHex(algo, h string) ([]byte, error) {
+	want, ok := hexLengths[algo]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q", algo)
+	}
+	normal := strings.ToLower(strings.TrimSpace(h))
+	if len(normal) != want {
+		return nil, fmt.Errorf("%s %q is not %d hex digits", algo, h, want)
+	}
+	hash, err := hex.DecodeString(normal)
+	if err != nil {
+		return nil, fmt.Errorf("%s %q: %v", algo, h, err)
+	}
+	return hash, nil
+}
+
+// HashToHex writes hash in lowercase hex, as every command and output shows
+// hashes.
+func HashToHex(hash []byte) string {
+	return hex.EncodeToString(hash)
+}
+
+// HashEncoding is a way of writing hashes as text, for working with tools
+// and datasets that don't use lowercase hex.
+type HashEncoding int
+
+const (
+	Hex      HashEncoding = iota // lowercase, as archive.org lists hashes
+	UpperHex                     // uppercase hex
+	Base32                       // RFC 4648 without padding, as in magnet links
+	Base64                       // standard RFC 4648, padded
+)
+
+var encodingNames = []string{"hex", "upper-hex", "base32", "base64"}
+
+func (e HashEncoding) String() string {
+	return encodingNames[e]
+}
+
+func (e HashEncoding) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+func (e *HashEncoding) UnmarshalText(text []byte) error {
+	for i, name := range encodingNames {
+		if string(text) == name {
+			*e = HashEncoding(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown hash encoding %q; want one of %s", text, strings.Join(encodingNames, ", "))
+}
+
+// Encode writes hash in e.
+func (e HashEncoding) Encode(hash []byte) string {
+	switch e {
+	case UpperHex:
+		return strings.ToUpper(hex.EncodeToString(hash))
+	case Base32:
+		return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(hash)
+	case Base64:
+		return base64.StdEncoding.EncodeToString(hash)
+	}
+	return HashToHex(hash)
+}
+
+// Decode reads a hash of algo written in e, as Encode writes it. As with
+// HashFromHex, surrounding space is ignored and the hash must be the right
+// length for algo. Case is ignored except in base64, and padding is optional.
+func (e HashEncoding) Decode(algo, s string) ([]byte, error) {
+	if e == Hex || e == UpperHex {
+		return HashFromHex(algo, s)
+	}
+	want, ok := hexLengths[algo]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q", algo)
+	}
+	normal := strings.TrimRight(strings.TrimSpace(s), "=")
+	var hash []byte
+	var err error
+	if e == Base32 {
+		hash, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(normal))
+	} else {
+		hash, err = base64.RawStdEncoding.DecodeString(normal)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s %q: %s: %v", algo, s, e, err)
+	}
+	if len(hash) != want/2 {
+		return nil, fmt.Errorf("%s %q is %d bytes in %s, not %d", algo, s, len(hash), e, want/2)
+	}
+	return hash, nil
+}
@@ -0,0 +1,155 @@
+package omnihash
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// FilesPerItem calls fn for each number of stored files an item has, in
+// increasing order, with how many items have that many. Rows are handed to fn
+// as they are read. A sharded database splits files across shards, so it
+// isn't supported.
+func (s *Storage) FilesPerItem(fn func(files, items int64) error) error {
+	if s.shards != nil {
+		return fmt.Errorf("files per item can't be counted in a sharded database")
+	}
+	return histogramRows(s.db, `SELECT n, COUNT(*) FROM (SELECT COUNT(*) AS n FROM files GROUP BY item)
+GROUP BY n ORDER BY n;`, nil, fn)
+}
+
+// HashOccurrences calls fn for each number of items a distinct algo hash is
+// found in, in increasing order, with how many hashes are found in that many;
+// the first row, for 1, counts the hashes only one item has. Rows are handed
+// to fn as they are read, except from a sharded database, whose shards are
+// summed first.
+func (s *Storage) HashOccurrences(algo string, fn func(items, hashes int64) error) error {
+	query := `SELECT n, COUNT(*) FROM (SELECT COUNT(DISTINCT f.item) AS n FROM file_hashes fh
+JOIN files f ON f.id = fh.file
+WHERE fh.algo = (?)
+GROUP BY fh.hash)
+GROUP BY n ORDER BY n;`
+	if s.shards == nil {
+		return histogramRows(s.db, query, []any{algo}, fn)
+	}
+	// a hash is only ever in one shard, so the counts can be added up
+	totals := make(map[int64]int64)
+	for _, shard := range s.shards {
+		err := histogramRows(shard.db, query, []any{algo}, func(k, n int64) error {
+			totals[k] += n
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	keys := make([]int64, 0, len(totals))
+	for k := range totals {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, k := range keys {
+		err := fn(k, totals[k])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func histogramRows(db *sql.DB, query string, args []any, fn func(k, n int64) error) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k, n int64
+		err = rows.Scan(&k, &n)
+		if err != nil {
+			return err
+		}
+		err = fn(k, n)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// UniqueHashes calls fn for the top collections by how many distinct algo
+// hashes are found only in items found in that collection, most first. top
+// limits how many are reported, if > 0. Collection is empty for items stored
+// before it was recorded.
+func (s *Storage) UniqueHashes(algo string, top int, fn func(collection string, hashes int64) error) error {
+	if s.shards == nil {
+		return s.uniqueHashes(algo, top, fn)
+	}
+	// a hash is only ever in one shard, so the counts can be added up
+	totals := make(map[string]int64)
+	for _, shard := range s.shards {
+		err := shard.uniqueHashes(algo, 0, func(collection string, hashes int64) error {
+			totals[collection] += hashes
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(totals))
+	for name := range totals {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if totals[names[i]] != totals[names[j]] {
+			return totals[names[i]] > totals[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if top > 0 && len(names) > top {
+		names = names[:top]
+	}
+	for _, name := range names {
+		err := fn(name, totals[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) uniqueHashes(algo string, top int, fn func(collection string, hashes int64) error) error {
+	column, err := columnOrNull(context.Background(), s.db, "main", "archive_items", "a", "source_collection")
+	if err != nil {
+		return err
+	}
+	limit := -1
+	if top > 0 {
+		limit = top
+	}
+	rows, err := s.db.Query(`SELECT c, COUNT(*) FROM (
+SELECT MIN(COALESCE(`+column+`, '')) AS c FROM file_hashes fh
+JOIN files f ON f.id = fh.file
+JOIN archive_items a ON a.id = f.item
+WHERE fh.algo = (?)
+GROUP BY fh.hash HAVING COUNT(DISTINCT COALESCE(`+column+`, '')) = 1)
+GROUP BY c ORDER BY 2 DESC, c LIMIT (?);`, algo, limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var collection string
+		var n int64
+		err = rows.Scan(&collection, &n)
+		if err != nil {
+			return err
+		}
+		err = fn(collection, n)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
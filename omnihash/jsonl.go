@@ -0,0 +1,67 @@
+package omnihash
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// JSONLines writes each entry as a line of JSON instead of storing it in a
+// database, leaving out the same files and hashes a Storage would. It isn't
+// safe for concurrent use; a Writer serializes calls to it.
+type JSONLines struct {
+	enc         *json.Encoder
+	derivatives bool
+}
+
+// NewJSONLines writes lines to w, with derivatives as in
+// StorageOptions.IndexDerivatives.
+func NewJSONLines(w io.Writer, derivatives bool) *JSONLines {
+	enc := json.NewEncoder(w)
+	// names are written as they are, e.g. with & rather than \u0026
+	enc.SetEscapeHTML(false)
+	return &JSONLines{enc: enc, derivatives: derivatives}
+}
+
+type jsonEntry struct {
+	Item       string `json:"item"`
+	Collection string `json:"collection,omitempty"`
+	// set if these are a collection's own files rather than an item's
+	IsCollection bool `json:"is_collection,omitempty"`
+	// every collection the item belongs to
+	Collections []string   `json:"collections,omitempty"`
+	Files       []jsonFile `json:"files"`
+}
+
+type jsonFile struct {
+	Name   string `json:"name"`
+	Format string `json:"format,omitempty"`
+	Source string `json:"source,omitempty"`
+	// hex encoded, by algorithm
+	Hashes map[string]string `json:"hashes"`
+}
+
+// NewEntries writes a line for each of entries, as NewEntry would.
+func (j *JSONLines) NewEntries(entries []Entry) []error {
+	errs := make([]error, len(entries))
+	for i, e := range entries {
+		errs[i] = j.NewEntry(e.Metadata, e.Item, e.Collection)
+	}
+	return errs
+}
+
+// NewEntry writes a line for item, found in collection, which may be empty.
+func (j *JSONLines) NewEntry(im *ItemMetadata, item, collection string) error {
+	files, err := decodeEntry(im, item, j.derivatives)
+	if err != nil {
+		return err
+	}
+	entry := jsonEntry{Item: item, Collection: collection, IsCollection: im.IsCollection, Collections: im.Collections}
+	for _, f := range files {
+		jf := jsonFile{Name: f.name, Format: f.format, Source: f.source, Hashes: make(map[string]string)}
+		for _, h := range f.hashes {
+			jf.Hashes[h.algo] = HashToHex(h.hash)
+		}
+		entry.Files = append(entry.Files, jf)
+	}
+	return j.enc.Encode(entry)
+}
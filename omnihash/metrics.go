@@ -0,0 +1,174 @@
+package omnihash
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how many seconds RequestsPerMinute looks back over
+const rateWindow = 60
+
+// Metrics holds counters for monitoring a crawl, served in the Prometheus
+// text format.
+type Metrics struct {
+	ItemsProcessed atomic.Int64
+	ItemsFailed    atomic.Int64
+	HashesInserted atomic.Int64
+	Retries        atomic.Int64
+	QueueLength    atomic.Int64
+	BreakerState   atomic.Int64
+	Paused         atomic.Bool
+
+	mu         sync.Mutex
+	httpErrors map[string]int64 // by status code, or "none" if there was no response
+	Rate       func() float64
+	WriteQueue func() int
+	// the page being crawled
+	collection string
+	page       int
+	// of the collection, as from Job.Progress
+	progress float64
+	// estimated time left to drain the queue, and the items it covers; eta
+	// is negative if unknown
+	eta       time.Duration
+	itemsLeft int64
+	// requests sent in each of the last rateWindow seconds, by unix time
+	// modulo rateWindow; a bucket whose second is stale counts for nothing
+	sent    [rateWindow]int64
+	sentSec [rateWindow]int64
+}
+
+var DefaultMetrics = Metrics{httpErrors: make(map[string]int64), eta: -1}
+
+func (m *Metrics) HTTPError(status string) {
+	m.mu.Lock()
+	m.httpErrors[status]++
+	m.mu.Unlock()
+}
+
+// HTTPErrors totals the failed requests of every status.
+func (m *Metrics) HTTPErrors() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, count := range m.httpErrors {
+		n += count
+	}
+	return n
+}
+
+// Request counts a request sent now.
+func (m *Metrics) Request() {
+	now := time.Now().Unix()
+	i := now % rateWindow
+	m.mu.Lock()
+	if m.sentSec[i] != now {
+		m.sentSec[i], m.sent[i] = now, 0
+	}
+	m.sent[i]++
+	m.mu.Unlock()
+}
+
+// RequestsPerMinute counts the requests sent in the last minute, which,
+// unlike the rate the limiter allows, reflects time lost to retries and slow
+// writes.
+func (m *Metrics) RequestsPerMinute() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.requestsPerMinute()
+}
+
+func (m *Metrics) requestsPerMinute() int64 {
+	now := time.Now().Unix()
+	var n int64
+	for i, sec := range m.sentSec {
+		if now-sec < rateWindow {
+			n += m.sent[i]
+		}
+	}
+	return n
+}
+
+func (m *Metrics) SetJob(collection string, page int) {
+	m.mu.Lock()
+	if collection != m.collection {
+		m.progress = -1
+	}
+	m.collection, m.page = collection, page
+	m.mu.Unlock()
+}
+
+// SetProgress records how much of the current collection has been crawled,
+// or -1 if that isn't known.
+func (m *Metrics) SetProgress(progress float64) {
+	m.mu.Lock()
+	m.progress = progress
+	m.mu.Unlock()
+}
+
+// SetETA records how long the items left in the queue are expected to take,
+// or a negative eta if that isn't known.
+func (m *Metrics) SetETA(eta time.Duration, itemsLeft int64) {
+	m.mu.Lock()
+	m.eta, m.itemsLeft = eta, itemsLeft
+	m.mu.Unlock()
+}
+
+func (m *Metrics) ETA() (eta time.Duration, itemsLeft int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.eta, m.itemsLeft
+}
+
+func (m *Metrics) Job() (collection string, page int, progress float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.collection, m.page, m.progress
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	counter := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	gauge := func(name, help string, v float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, v)
+	}
+	counter("omnihash_items_processed_total", "Items fetched from archive.org.", m.ItemsProcessed.Load())
+	counter("omnihash_items_failed_total", "Items that couldn't be fetched or stored.", m.ItemsFailed.Load())
+	counter("omnihash_hashes_inserted_total", "Hashes stored in the database.", m.HashesInserted.Load())
+	counter("omnihash_retries_total", "Requests retried after a failure.", m.Retries.Load())
+	gauge("omnihash_queue_length", "Collections waiting to be crawled.", float64(m.QueueLength.Load()))
+	gauge("omnihash_circuit_breaker_state", "0 if requests flow, 1 while probing, 2 while paused after failures.", float64(m.BreakerState.Load()))
+	paused := 0.0
+	if m.Paused.Load() {
+		paused = 1
+	}
+	gauge("omnihash_paused", "1 while requests are paused on request, else 0.", paused)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Rate != nil {
+		gauge("omnihash_request_rate", "Requests per second the rate limiter allows.", m.Rate())
+	}
+	gauge("omnihash_requests_last_minute", "Requests sent in the last minute.", float64(m.requestsPerMinute()))
+	if m.eta >= 0 {
+		gauge("omnihash_eta_seconds", "Estimated time to crawl the items left in queued collections of known size.", m.eta.Seconds())
+	}
+	if m.WriteQueue != nil {
+		gauge("omnihash_write_queue_length", "Fetched items waiting to be stored.", float64(m.WriteQueue()))
+	}
+	fmt.Fprintf(w, "# HELP omnihash_http_errors_total Failed requests to archive.org.\n# TYPE omnihash_http_errors_total counter\n")
+	statuses := make([]string, 0, len(m.httpErrors))
+	for status := range m.httpErrors {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(w, "omnihash_http_errors_total{status=%q} %d\n", status, m.httpErrors[status])
+	}
+}
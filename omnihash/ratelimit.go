@@ -0,0 +1,139 @@
+package omnihash
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// AdaptiveLimiter spaces out requests to archive.org. Every host gets a
+// token bucket, and all of them share one rate: it rises a little after
+// every successful response and halves whenever the server says it is
+// overloaded (additive increase, multiplicative decrease), staying between
+// min and max requests per second. Each wait is randomly lengthened or
+// shortened by up to the jitter fraction, so several crawlers don't fall into
+// step with each other.
+type AdaptiveLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	min    float64
+	max    float64
+	burst  int
+	jitter float64
+	hosts  map[string]*rate.Limiter
+	// non-nil while paused, and closed on resuming
+	resumed chan struct{}
+}
+
+// how many requests per second to add after each successful request
+const rateStep = 0.05
+
+func NewAdaptiveLimiter(min, max float64, burst int, jitter float64) *AdaptiveLimiter {
+	l := AdaptiveLimiter{rate: 1, min: min, max: max, burst: burst, jitter: jitter, hosts: make(map[string]*rate.Limiter)}
+	l.clamp()
+	return &l
+}
+
+func (l *AdaptiveLimiter) clamp() {
+	if l.rate > l.max {
+		l.rate = l.max
+	}
+	if l.rate < l.min {
+		l.rate = l.min
+	}
+}
+
+// setRate must be called with l.mu held.
+func (l *AdaptiveLimiter) setRate(r float64) {
+	l.rate = r
+	l.clamp()
+	for _, hl := range l.hosts {
+		hl.SetLimit(rate.Limit(l.rate))
+	}
+}
+
+// Wait blocks until the next request to host may be sent, or ctx is done.
+func (l *AdaptiveLimiter) Wait(ctx context.Context, host string) error {
+	l.mu.Lock()
+	for l.resumed != nil {
+		resumed := l.resumed
+		l.mu.Unlock()
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		l.mu.Lock()
+	}
+	hl, ok := l.hosts[host]
+	if !ok {
+		hl = rate.NewLimiter(rate.Limit(l.rate), l.burst)
+		l.hosts[host] = hl
+	}
+	l.mu.Unlock()
+
+	r := hl.Reserve()
+	delay := float64(r.Delay()) * (1 + l.jitter*(2*rand.Float64()-1))
+	t := time.NewTimer(time.Duration(delay))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		// give the token back for the next request
+		r.Cancel()
+		return ctx.Err()
+	}
+}
+
+// Feedback adjusts the rate according to the status of a response.
+func (l *AdaptiveLimiter) Feedback(status int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		l.setRate(l.rate / 2)
+		log.Printf("got status %d; slowing down to %.2f requests/s\n", status, l.rate)
+	case status < 400:
+		l.setRate(l.rate + rateStep)
+	}
+}
+
+// Pause holds back every request not yet sent until Resume is called. It
+// returns false if the limiter was already paused.
+func (l *AdaptiveLimiter) Pause() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.resumed != nil {
+		return false
+	}
+	l.resumed = make(chan struct{})
+	DefaultMetrics.Paused.Store(true)
+	return true
+}
+
+// Resume lets requests held back by Pause be sent. It returns false if the
+// limiter wasn't paused.
+func (l *AdaptiveLimiter) Resume() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.resumed == nil {
+		return false
+	}
+	close(l.resumed)
+	l.resumed = nil
+	DefaultMetrics.Paused.Store(false)
+	return true
+}
+
+// Rate returns the current requests per second.
+func (l *AdaptiveLimiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
@@ -0,0 +1,196 @@
+package omnihash
+
+import (
+	"database/sql"
+)
+
+// how many items Repair fixes per transaction
+const repairBatchSize = 1000
+
+// RepairStats counts what Repair removed.
+type RepairStats struct {
+	Hashes int64 // of the wrong length for their algorithm
+	Files  int64 // that wouldn't be stored now, or had no hashes left
+	Items  int64 // that had no files left
+}
+
+// Repair brings rows stored by older versions in line with what would be
+// stored now: hashes of the wrong length for their algorithm and files that
+// are now skipped, such as thumbnails or the hashes of a torrent, are
+// removed. Items left without any files are removed too, and passed to fn so
+// they can be fetched again. Whatever isn't recorded, such as when an item
+// was indexed, can't be filled in.
+func (s *Storage) Repair(fn func(item string)) (RepairStats, error) {
+	var total RepairStats
+	for _, shard := range s.shards {
+		st, err := shard.Repair(fn)
+		total.Hashes += st.Hashes
+		total.Files += st.Files
+		total.Items += st.Items
+		if err != nil {
+			return total, err
+		}
+	}
+	if s.shards != nil {
+		return total, nil
+	}
+	var after int64
+	for {
+		last, err := s.repairBatch(after, &total, fn)
+		if err != nil || last == after {
+			return total, err
+		}
+		after = last
+	}
+}
+
+type repairFile struct {
+	item   string
+	name   string
+	source string
+	hashes []fileHash
+}
+
+type repairHash struct {
+	file int64
+	algo string
+}
+
+// repairBatch repairs the items with the repairBatchSize ids after after,
+// returning the last id, or after if there were none.
+func (s *Storage) repairBatch(after int64, total *RepairStats, fn func(item string)) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return after, err
+	}
+	defer tx.Rollback()
+
+	var last int64
+	err = tx.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM (SELECT id FROM archive_items WHERE id > (?) ORDER BY id LIMIT (?));`, after, repairBatchSize).Scan(&last)
+	if err != nil || last == 0 {
+		return after, err
+	}
+
+	// files migrated from the old hashes table have no name
+	rows, err := tx.Query(`SELECT ai.name, f.id, COALESCE(f.name, ''), COALESCE(f.source, ''), fh.algo, fh.hash
+FROM files f
+JOIN archive_items ai ON ai.id = f.item
+LEFT JOIN file_hashes fh ON fh.file = f.id
+WHERE f.item > (?) AND f.item <= (?);`, after, last)
+	if err != nil {
+		return after, err
+	}
+	files := make(map[int64]*repairFile)
+	var badHashes []repairHash
+	var badFiles []int64
+	for rows.Next() {
+		var item, name, source string
+		var id int64
+		var algo sql.NullString
+		var hash []byte
+		err = rows.Scan(&item, &id, &name, &source, &algo, &hash)
+		if err != nil {
+			rows.Close()
+			return after, err
+		}
+		f, ok := files[id]
+		if !ok {
+			f = &repairFile{item: item, name: name, source: source}
+			files[id] = f
+		}
+		if !algo.Valid {
+			continue
+		}
+		h := fileHash{algo.String, HashToHex(hash)}
+		if len(h.hex) != hexLengths[h.algo] {
+			badHashes = append(badHashes, repairHash{id, h.algo})
+			continue
+		}
+		f.hashes = append(f.hashes, h)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return after, err
+	}
+
+	for id, f := range files {
+		file := File{Name: f.name, Source: f.source}
+		for _, h := range f.hashes {
+			if h.algo == "btih" {
+				file.Btih = h.hex
+			}
+		}
+		// derivatives are kept, since storing them was up to the
+		// crawl that did
+		if skipReason(f.item, &file, true) != "" {
+			badFiles = append(badFiles, id)
+			continue
+		}
+		kept := 0
+		for _, h := range f.hashes {
+			if skipHashReason(f.item, &file, h) != "" {
+				badHashes = append(badHashes, repairHash{id, h.algo})
+				continue
+			}
+			kept++
+		}
+		if kept == 0 {
+			badFiles = append(badFiles, id)
+		}
+	}
+
+	for _, h := range badHashes {
+		_, err = tx.Exec(`DELETE FROM file_hashes WHERE file = (?) AND algo = (?);`, h.file, h.algo)
+		if err != nil {
+			return after, err
+		}
+	}
+	for _, id := range badFiles {
+		_, err = tx.Exec(`DELETE FROM file_hashes WHERE file = (?);`, id)
+		if err != nil {
+			return after, err
+		}
+		_, err = tx.Exec(`DELETE FROM files WHERE id = (?);`, id)
+		if err != nil {
+			return after, err
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM item_collections
+WHERE item > (?) AND item <= (?) AND NOT EXISTS (SELECT 1 FROM files WHERE item = item_collections.item);`, after, last)
+	if err != nil {
+		return after, err
+	}
+	var empty []string
+	rows, err = tx.Query(`DELETE FROM archive_items
+WHERE id > (?) AND id <= (?) AND NOT EXISTS (SELECT 1 FROM files WHERE item = archive_items.id)
+RETURNING name;`, after, last)
+	if err != nil {
+		return after, err
+	}
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			rows.Close()
+			return after, err
+		}
+		empty = append(empty, name)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return after, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return after, err
+	}
+	total.Hashes += int64(len(badHashes))
+	total.Files += int64(len(badFiles))
+	total.Items += int64(len(empty))
+	for _, name := range empty {
+		fn(name)
+	}
+	return last, nil
+}
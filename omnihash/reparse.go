@@ -0,0 +1,139 @@
+package omnihash
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// ReparseStats counts what Reparse filled in.
+type ReparseStats struct {
+	Items int64 // with a stored listing
+	Files int64 // given a value they were missing
+}
+
+// Reparse fills in what older versions didn't store about files, such as
+// their format or source, from the listings kept with KeepListings, without
+// fetching anything from archive.org. Items stored without a listing are left
+// alone.
+func (s *Storage) Reparse() (ReparseStats, error) {
+	var total ReparseStats
+	for _, shard := range s.shards {
+		st, err := shard.Reparse()
+		total.Items += st.Items
+		total.Files += st.Files
+		if err != nil {
+			return total, err
+		}
+	}
+	if s.shards != nil {
+		return total, nil
+	}
+	var after int64
+	for {
+		last, err := s.reparseBatch(after, &total)
+		if err != nil || last == after {
+			return total, err
+		}
+		after = last
+	}
+}
+
+type reparseItem struct {
+	id      int64
+	name    string
+	listing []byte
+}
+
+// reparseBatch reparses up to repairBatchSize items with ids after after,
+// returning the last id, or after if there were none.
+func (s *Storage) reparseBatch(after int64, total *ReparseStats) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return after, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, name, files_json FROM archive_items WHERE id > (?) AND files_json IS NOT NULL ORDER BY id LIMIT (?);`, after, repairBatchSize)
+	if err != nil {
+		return after, err
+	}
+	var items []reparseItem
+	for rows.Next() {
+		var it reparseItem
+		err = rows.Scan(&it.id, &it.name, &it.listing)
+		if err != nil {
+			rows.Close()
+			return after, err
+		}
+		items = append(items, it)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return after, err
+	}
+	if len(items) == 0 {
+		return after, nil
+	}
+
+	var filled int64
+	for _, it := range items {
+		raw, err := gunzipBytes(it.listing)
+		if err != nil {
+			return after, fmt.Errorf("item %s: %w", it.name, err)
+		}
+		var files []File
+		err = json.Unmarshal(raw, &files)
+		if err != nil {
+			return after, fmt.Errorf("item %s: %w", it.name, err)
+		}
+		for _, f := range files {
+			if f.Format == "" && f.Source == "" {
+				continue
+			}
+			res, err := tx.Exec(`UPDATE files SET format = COALESCE(format, NULLIF((?), '')), source = COALESCE(source, NULLIF((?), ''))
+WHERE item = (?) AND name = (?) AND ((format IS NULL AND (?) != '') OR (source IS NULL AND (?) != ''));`, f.Format, f.Source, it.id, f.Name, f.Format, f.Source)
+			if err != nil {
+				return after, err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return after, err
+			}
+			filled += n
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return after, err
+	}
+	total.Items += int64(len(items))
+	total.Files += filled
+	return items[len(items)-1].id, nil
+}
@@ -0,0 +1,217 @@
+package omnihash
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// A sharded database keeps its rows in several files, each holding the
+// hashes whose first byte maps to it, so no single file grows unwieldy. The
+// file at the path the database was opened with only records how many
+// shards there are. Each shard is an ordinary database: an item whose files
+// have hashes in several shards is stored in each of them, with just the
+// hashes that belong there.
+
+// NewShardedStorage opens the sharded database at dbPath, creating it with n
+// shards if it doesn't exist. An existing database can't be resharded.
+func NewShardedStorage(dbPath string, n int, opts StorageOptions) (*Storage, error) {
+	if n < 2 || n > 256 {
+		return nil, fmt.Errorf("need 2 <= shards (%d) <= 256", n)
+	}
+	s, err := NewStorage(dbPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	if s.shards != nil {
+		if len(s.shards) != n {
+			s.Close()
+			return nil, fmt.Errorf("%s already has %d shards", dbPath, len(s.shards))
+		}
+		return s, nil
+	}
+
+	var items int
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM archive_items;`).Scan(&items)
+	if err == nil && items != 0 {
+		err = fmt.Errorf("%s already holds items in a single file, so it can't be sharded", dbPath)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	_, err = s.db.Exec(`CREATE TABLE shards (count INTEGER NOT NULL);
+INSERT INTO shards (count) VALUES (?);`, n)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.shards, err = openShards(dbPath, n, opts.open)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// shardCount returns how many shards the database has, or 0 if it isn't
+// sharded.
+func shardCount(db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'shards';`).Scan(&n)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	err = db.QueryRow(`SELECT count FROM shards;`).Scan(&n)
+	return n, err
+}
+
+// shardPath names the files of the shards of dbPath, e.g. hashes-03.db.
+func shardPath(dbPath string, i int) string {
+	ext := filepath.Ext(dbPath)
+	return fmt.Sprintf("%s-%02x%s", strings.TrimSuffix(dbPath, ext), i, ext)
+}
+
+// open opens a shard for writing with the options of the database it's in.
+func (opts StorageOptions) open(path string) (*Storage, error) {
+	return NewStorage(path, opts)
+}
+
+func openShards(dbPath string, n int, open func(string) (*Storage, error)) ([]*Storage, error) {
+	shards := make([]*Storage, n)
+	for i := range shards {
+		var err error
+		shards[i], err = open(shardPath(dbPath, i))
+		if err != nil {
+			for _, shard := range shards[:i] {
+				shard.Close()
+			}
+			return nil, err
+		}
+	}
+	return shards, nil
+}
+
+func (s *Storage) shardFor(hash []byte) *Storage {
+	if len(hash) == 0 {
+		return s.shards[0]
+	}
+	return s.shards[int(hash[0])%len(s.shards)]
+}
+
+// shardForHex is shardFor for a hash as archive.org lists it. Anything that
+// doesn't start with a hex byte goes to the first shard, which rejects it.
+func (s *Storage) shardForHex(h string) *Storage {
+	h = strings.ToLower(strings.TrimSpace(h))
+	if len(h) < 2 {
+		return s.shards[0]
+	}
+	b, err := hex.DecodeString(h[:2])
+	if err != nil {
+		return s.shards[0]
+	}
+	return s.shardFor(b)
+}
+
+// newEntryShards splits the hashes of im by shard and stores each part as
+// its own entry.
+func (s *Storage) newEntryShards(im *ItemMetadata, item, collection string) error {
+	parts := make(map[*Storage]*ItemMetadata)
+	for _, f := range im.Files {
+		byShard := make(map[*Storage][]fileHash)
+		for _, h := range f.Hashes() {
+			shard := s.shardForHex(h.hex)
+			byShard[shard] = append(byShard[shard], h)
+		}
+		for shard, hashes := range byShard {
+			if parts[shard] == nil {
+				// each shard keeps the whole listing, so it can be
+				// reparsed on its own
+				parts[shard] = &ItemMetadata{IsCollection: im.IsCollection, Collections: im.Collections, RawFiles: im.RawFiles}
+			}
+			parts[shard].Files = append(parts[shard].Files, f.withHashes(hashes))
+		}
+	}
+	stored, already := false, false
+	for _, shard := range s.shards {
+		part := parts[shard]
+		if part == nil {
+			continue
+		}
+		err := shard.NewEntry(part, item, collection)
+		if errors.Is(err, errNoValidFiles) {
+			continue
+		}
+		// other shards may still lack their part
+		if errors.Is(err, ErrAlreadyStored) {
+			already = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		stored = true
+	}
+	if !stored && already {
+		return ErrAlreadyStored
+	}
+	if !stored {
+		return errNoValidFiles
+	}
+	return nil
+}
+
+// lookupBatchShards looks up each hash in its shard, still calling fn in the
+// order of hashes.
+func (s *Storage) lookupBatchShards(algo string, hashes [][]byte, fn func(i int, items []string) error) error {
+	found := make([][]string, len(hashes))
+	indices := make(map[*Storage][]int)
+	for i, hash := range hashes {
+		shard := s.shardFor(hash)
+		indices[shard] = append(indices[shard], i)
+	}
+	for shard, is := range indices {
+		batch := make([][]byte, len(is))
+		for j, i := range is {
+			batch[j] = hashes[i]
+		}
+		err := shard.LookupBatch(algo, batch, func(j int, items []string) error {
+			found[is[j]] = items
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for i, items := range found {
+		err := fn(i, items)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statsShards adds up the stats of the shards. An item with hashes in
+// several shards is counted once in each.
+func (s *Storage) statsShards() (*Stats, error) {
+	var total Stats
+	for _, shard := range s.shards {
+		st, err := shard.Stats()
+		if err != nil {
+			return nil, err
+		}
+		total.Items += st.Items
+		total.Files += st.Files
+		total.Hashes += st.Hashes
+		total.DistinctHashes += st.DistinctHashes
+		total.Size += st.Size
+	}
+	if total.Items > 0 {
+		total.FilesPerItem = float64(total.Files) / float64(total.Items)
+	}
+	return &total, nil
+}
@@ -0,0 +1,1474 @@
+package omnihash
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// openSQLite opens a database for writing. WAL lets readers and a writer use
+// it at once, and since a crawl and subcommands may write to the same file,
+// connections wait a while for a lock instead of failing at once. Foreign
+// keys are enforced, which SQLite only does when asked on each connection.
+func openSQLite(path string) (*sql.DB, error) {
+	return sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=1")
+}
+
+// DefaultBusyRetries is how many times a write is tried while another
+// connection holds the database locked, unless a storage or task queue is
+// opened with a count of its own.
+const DefaultBusyRetries = 5
+
+// retryBusy calls f until it stops failing because another connection holds
+// a lock on the database, waiting a little longer each time, and gives up
+// after tries attempts, making at least one. _busy_timeout already covers most contention,
+// but SQLite returns SQLITE_BUSY at once when waiting could deadlock. f must
+// start over from scratch, e.g. by running its whole transaction again: a
+// Commit that fails as busy has already been rolled back.
+func retryBusy(tries int, f func() error) error {
+	var err error
+	for attempt := 0; attempt < max(tries, 1); attempt++ {
+		err = f()
+		if !isBusy(err) {
+			return err
+		}
+		time.Sleep(time.Duration(50<<attempt) * time.Millisecond)
+	}
+	return err
+}
+
+func isBusy(err error) bool {
+	var serr sqlite3.Error
+	return errors.As(err, &serr) && (serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked)
+}
+
+func execRetry(tries int, stmt *sql.Stmt, args ...any) error {
+	return retryBusy(tries, func() error {
+		_, err := stmt.Exec(args...)
+		return err
+	})
+}
+
+// addColumn adds a column to a table made before the column existed, and does
+// nothing if it's already there.
+func addColumn(db *sql.DB, table, column, decl string) error {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = (?);`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + decl + `;`)
+	return err
+}
+
+type Storage struct {
+	db      *sql.DB
+	path    string
+	opts    StorageOptions
+	insName *sql.Stmt
+	insFile *sql.Stmt
+	insHash *sql.Stmt
+	insColl *sql.Stmt
+	lookup  *sql.Stmt
+	// holds a value for each NewEntries call writing at the moment, so
+	// its capacity is how many may; see SetWriteConcurrency
+	writes chan struct{}
+	// if the database is sharded, where its rows are; see NewShardedStorage
+	shards []*Storage
+}
+
+var (
+	errNoFiles      = errors.New("no files")
+	errNoValidFiles = errors.New("no valid files")
+)
+
+// ErrAlreadyStored is the error for an item stored under the same name
+// before, unless the storage's OnDuplicate is DuplicateError and the item
+// was found in another collection the first time.
+var ErrAlreadyStored = errors.New("already stored")
+
+func isUnique(err error) bool {
+	var serr sqlite3.Error
+	return errors.As(err, &serr) && serr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// StorageOptions are how a Storage writes items. They are fixed when it is
+// opened, and its shards share them.
+type StorageOptions struct {
+	OnDuplicate DuplicatePolicy
+	// whether files archive.org derived from others, such as thumbnails or
+	// OCR text, are stored along with the originals
+	IndexDerivatives bool
+	// whether each item's file listing is stored as archive.org sent it,
+	// gzipped, so that Reparse can fill in columns added later without
+	// fetching the item again; it makes the database much larger
+	KeepListings bool
+	// how many times to try storing a batch while another connection
+	// holds the database locked; DefaultBusyRetries if 0
+	BusyRetries int
+}
+
+func NewStorage(dbPath string, opts StorageOptions) (*Storage, error) {
+	if opts.BusyRetries == 0 {
+		opts.BusyRetries = DefaultBusyRetries
+	}
+	s := Storage{path: dbPath, opts: opts, writes: make(chan struct{}, 1)}
+	var err error
+
+	s.db, err = openSQLite(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	n, err := shardCount(s.db)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if n > 0 {
+		s.shards, err = openShards(dbPath, n, opts.open)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		return &s, nil
+	}
+
+	_, err = s.db.Exec(`CREATE TABLE IF NOT EXISTS archive_items (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+name VARCHAR(255) UNIQUE NOT NULL,
+indexed_at INTEGER,
+source_collection VARCHAR(255)
+);
+CREATE TABLE IF NOT EXISTS files (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+item INTEGER NOT NULL,
+name TEXT,
+format TEXT,
+source TEXT,
+FOREIGN KEY (item) REFERENCES archive_items(id)
+);
+CREATE TABLE IF NOT EXISTS file_hashes (
+file INTEGER NOT NULL,
+algo VARCHAR(16) NOT NULL,
+hash BLOB NOT NULL,
+PRIMARY KEY (file, algo),
+FOREIGN KEY (file) REFERENCES files(id)
+);
+CREATE INDEX IF NOT EXISTS idx_algo_hash ON file_hashes(algo, hash);
+-- for finding an item's files, e.g. to delete them; costs a little on every
+-- insert
+CREATE INDEX IF NOT EXISTS idx_file_item ON files(item);
+-- every collection an item belongs to, not just the one it was found in
+CREATE TABLE IF NOT EXISTS item_collections (
+item INTEGER NOT NULL,
+collection VARCHAR(255) NOT NULL,
+PRIMARY KEY (item, collection),
+FOREIGN KEY (item) REFERENCES archive_items(id)
+);
+CREATE INDEX IF NOT EXISTS idx_collection_item ON item_collections(collection);`)
+	if err != nil {
+		return nil, err
+	}
+	err = s.migrateHashes()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	// unix time; NULL for items indexed before it was recorded
+	err = addColumn(s.db, "archive_items", "indexed_at", "INTEGER")
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	// the collection being crawled when the item was found; NULL if unknown
+	err = addColumn(s.db, "archive_items", "source_collection", "VARCHAR(255)")
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	// the file listing gzipped, if the storage kept listings when the
+	// item was stored
+	err = addColumn(s.db, "archive_items", "files_json", "BLOB")
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	// 1 if the row holds a collection's own files, such as its logo,
+	// rather than an item's
+	err = addColumn(s.db, "archive_items", "is_collection", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	// archive.org's name for the file's format, e.g. "VBR MP3"
+	err = addColumn(s.db, "files", "format", "TEXT")
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	// whether archive.org lists the file as uploaded (original), made
+	// from another (derivative), or its own (metadata)
+	err = addColumn(s.db, "files", "source", "TEXT")
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	// ids come back with RETURNING rather than LastInsertId, which not every
+	// database driver supports
+	s.insName, err = s.db.Prepare(`INSERT INTO archive_items (name, indexed_at, source_collection, files_json, is_collection) VALUES (?, ?, NULLIF((?), ''), ?, ?) RETURNING id;`)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.insFile, err = s.db.Prepare(`INSERT INTO files (item, name, format, source) VALUES (?, ?, NULLIF((?), ''), NULLIF((?), '')) RETURNING id;`)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.insHash, err = s.db.Prepare(`INSERT INTO file_hashes (file, algo, hash) VALUES (?, ?, ?);`)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	// metadata can list a collection twice
+	s.insColl, err = s.db.Prepare(`INSERT OR IGNORE INTO item_collections (item, collection) VALUES (?, ?);`)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	err = s.prepareLookups()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// NewReadOnlyStorage opens an existing database for queries only. It can be
+// used alongside a crawler writing to the same file, and can't modify it.
+func NewReadOnlyStorage(dbPath string) (*Storage, error) {
+	s := Storage{path: dbPath, writes: make(chan struct{}, 1)}
+	var err error
+
+	s.db, err = sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'hashes';`).Scan(&n)
+	if err == nil && n != 0 {
+		err = fmt.Errorf("%s uses an old schema; open it for writing once (e.g. by crawling) to migrate it", dbPath)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	n, err = shardCount(s.db)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if n > 0 {
+		s.shards, err = openShards(dbPath, n, NewReadOnlyStorage)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		return &s, nil
+	}
+	err = s.prepareLookups()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (s *Storage) prepareLookups() (err error) {
+	s.lookup, err = s.db.Prepare(`SELECT DISTINCT a.name FROM file_hashes fh
+JOIN files f ON f.id = fh.file
+JOIN archive_items a ON a.id = f.item
+WHERE fh.algo = (?) AND fh.hash = (?);`)
+	return
+}
+
+// Databases made before files could carry several hashes have a hashes
+// table of (sha1, item). Each of its rows becomes a nameless file with a
+// single sha1 hash.
+func (s *Storage) migrateHashes() error {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'hashes';`).Scan(&n)
+	if err != nil || n == 0 {
+		return err
+	}
+
+	log.Println("migrating hashes table to files and file_hashes")
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	var offset int64
+	err = tx.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM files;`).Scan(&offset)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	// hashes of items that no longer exist couldn't be found by name
+	// anyway, and foreign keys now keep them out
+	_, err = tx.Exec(`INSERT INTO files (id, item, name) SELECT rowid + (?), item, NULL FROM hashes WHERE item IN (SELECT id FROM archive_items);`, offset)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO file_hashes (file, algo, hash) SELECT rowid + (?), 'sha1', hash FROM hashes WHERE item IN (SELECT id FROM archive_items);`, offset)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`DROP TABLE hashes;`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Flush folds the write-ahead log back into the database file and truncates
+// it, leaving a single compact file. Entries are committed as they are made,
+// so there is nothing else to write out.
+func (s *Storage) Flush() error {
+	for _, shard := range s.shards {
+		err := shard.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	_, err := s.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE);`)
+	return err
+}
+
+// columnOrNull returns what to select for column of table, which is
+// qualified as alias, in the database schema of q, such as "main", or "src"
+// for one attached: the column itself, or NULL if the database is too old to
+// have it, as one opened read-only or attached may be.
+func columnOrNull(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}, schema, table, alias, column string) (string, error) {
+	var n int
+	err := q.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_table_info((?), (?)) WHERE name = (?);`, table, schema, column).Scan(&n)
+	if err != nil || n == 0 {
+		return "NULL", err
+	}
+	return alias + "." + column, nil
+}
+
+// Vacuum rebuilds the database to reclaim the space left by deleted rows and
+// refreshes the statistics the query planner uses. It returns the size of the
+// file before and after.
+func (s *Storage) Vacuum() (before, after int64, err error) {
+	if s.shards != nil {
+		for _, shard := range s.shards {
+			b, a, err := shard.Vacuum()
+			if err != nil {
+				return before, after, err
+			}
+			before, after = before+b, after+a
+		}
+		return
+	}
+	before, err = s.flushedSize()
+	if err != nil {
+		return
+	}
+	_, err = s.db.Exec(`VACUUM;`)
+	if err != nil {
+		return
+	}
+	_, err = s.db.Exec(`ANALYZE;`)
+	if err != nil {
+		return
+	}
+	after, err = s.flushedSize()
+	return
+}
+
+func (s *Storage) flushedSize() (int64, error) {
+	err := s.Flush()
+	if err != nil {
+		return 0, err
+	}
+	return s.Size()
+}
+
+// Size returns how many bytes the database takes on disk, counting its
+// write-ahead log and any shards.
+func (s *Storage) Size() (int64, error) {
+	var total int64
+	for _, shard := range s.shards {
+		n, err := shard.Size()
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	for _, path := range []string{s.path, s.path + "-wal"} {
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			// there's no log once it's been checkpointed and closed
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		total += fi.Size()
+	}
+	return total, nil
+}
+
+func (s *Storage) Close() {
+	for _, shard := range s.shards {
+		shard.Close()
+	}
+	if s.lookup != nil {
+		s.lookup.Close()
+	}
+	if s.insHash != nil {
+		s.insHash.Close()
+	}
+	if s.insColl != nil {
+		s.insColl.Close()
+	}
+	if s.insFile != nil {
+		s.insFile.Close()
+	}
+	if s.insName != nil {
+		s.insName.Close()
+	}
+	if s.db != nil {
+		s.db.Close()
+	}
+}
+
+// Lookup returns the names of the items containing a file with the hash,
+// computed by algo (sha1, md5, ...).
+func (s *Storage) Lookup(algo string, hash []byte) ([]string, error) {
+	if s.shards != nil {
+		return s.shardFor(hash).Lookup(algo, hash)
+	}
+	return lookupWith(s.lookup, algo, hash)
+}
+
+// LookupBatch looks up many hashes at once, calling fn with the index of each
+// hash in hashes and the names of the items containing it. Looking them up
+// in a single transaction is much faster than separate calls to Lookup.
+func (s *Storage) LookupBatch(algo string, hashes [][]byte, fn func(i int, items []string) error) error {
+	if s.shards != nil {
+		return s.lookupBatchShards(algo, hashes, fn)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	lookup := tx.Stmt(s.lookup)
+	for i, hash := range hashes {
+		names, err := lookupWith(lookup, algo, hash)
+		if err != nil {
+			return err
+		}
+		err = fn(i, names)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func lookupWith(stmt *sql.Stmt, algo string, hash []byte) ([]string, error) {
+	rows, err := stmt.Query(algo, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+type Stats struct {
+	Items          int64
+	Files          int64
+	Hashes         int64
+	DistinctHashes int64
+	FilesPerItem   float64
+	Size           int64 // bytes on disk
+}
+
+func (s *Storage) Stats() (*Stats, error) {
+	if s.shards != nil {
+		return s.statsShards()
+	}
+	var st Stats
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM archive_items;`).Scan(&st.Items)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM files;`).Scan(&st.Files)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM file_hashes;`).Scan(&st.Hashes)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM (SELECT DISTINCT algo, hash FROM file_hashes);`).Scan(&st.DistinctHashes)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.QueryRow(`SELECT COALESCE(AVG(n), 0) FROM (SELECT COUNT(*) AS n FROM files GROUP BY item);`).Scan(&st.FilesPerItem)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	st.Size = fi.Size()
+	return &st, nil
+}
+
+// CollectionCount is how many of the stored items were found in a
+// collection, and how many hashes their files have. Collection is empty for
+// items stored before it was recorded.
+type CollectionCount struct {
+	Collection string
+	Items      int64
+	Hashes     int64
+}
+
+// Collections counts the stored items by the collection they were found in,
+// most items first. Hashes are only counted if withHashes is set, as that
+// reads the whole index. An item with hashes in several shards is counted
+// once in each.
+func (s *Storage) Collections(withHashes bool) ([]CollectionCount, error) {
+	counts := make(map[string]*CollectionCount)
+	err := s.collections(withHashes, counts)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]CollectionCount, 0, len(counts))
+	for _, c := range counts {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Items != list[j].Items {
+			return list[i].Items > list[j].Items
+		}
+		return list[i].Collection < list[j].Collection
+	})
+	return list, nil
+}
+
+// Members returns the stored items that belong to collection, in order,
+// whether or not they were found through it.
+func (s *Storage) Members(collection string) ([]string, error) {
+	found := make(map[string]bool)
+	err := s.members(collection, found)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *Storage) members(collection string, found map[string]bool) error {
+	for _, shard := range s.shards {
+		err := shard.members(collection, found)
+		if err != nil {
+			return err
+		}
+	}
+	if s.shards != nil {
+		return nil
+	}
+	// a database only opened read-only since the table was added lacks it
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'item_collections';`).Scan(&n)
+	if err != nil || n == 0 {
+		return err
+	}
+	rows, err := s.db.Query(`SELECT ai.name FROM item_collections ic
+JOIN archive_items ai ON ai.id = ic.item
+WHERE ic.collection = (?);`, collection)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return err
+		}
+		found[name] = true
+	}
+	return rows.Err()
+}
+
+func (s *Storage) collections(withHashes bool, counts map[string]*CollectionCount) error {
+	for _, shard := range s.shards {
+		err := shard.collections(withHashes, counts)
+		if err != nil {
+			return err
+		}
+	}
+	if s.shards != nil {
+		return nil
+	}
+	column, err := columnOrNull(context.Background(), s.db, "main", "archive_items", "ai", "source_collection")
+	if err != nil {
+		return err
+	}
+
+	query := `SELECT COALESCE(` + column + `, ''), COUNT(*), 0 FROM archive_items ai GROUP BY 1;`
+	if withHashes {
+		query = `SELECT COALESCE(` + column + `, ''), COUNT(DISTINCT ai.id), COUNT(fh.file)
+FROM archive_items ai
+LEFT JOIN files f ON f.item = ai.id
+LEFT JOIN file_hashes fh ON fh.file = f.id
+GROUP BY 1;`
+	}
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c CollectionCount
+		err = rows.Scan(&c.Collection, &c.Items, &c.Hashes)
+		if err != nil {
+			return err
+		}
+		if total, ok := counts[c.Collection]; ok {
+			total.Items += c.Items
+			total.Hashes += c.Hashes
+		} else {
+			counts[c.Collection] = &c
+		}
+	}
+	return rows.Err()
+}
+
+// StoredFile is a file of a stored item, with its hashes by algorithm.
+type StoredFile struct {
+	Name   string
+	Format string
+	Hashes map[string][]byte
+}
+
+// FilesForItem returns the stored files of the item name, by name, or none
+// if it isn't stored.
+func (s *Storage) FilesForItem(name string) ([]StoredFile, error) {
+	byName := make(map[string]*StoredFile)
+	err := s.filesForItem(name, byName)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]StoredFile, 0, len(byName))
+	for _, f := range byName {
+		files = append(files, *f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files, nil
+}
+
+// filesForItem adds the files of the item name to byName. In a sharded
+// database, each shard has some of a file's hashes.
+func (s *Storage) filesForItem(name string, byName map[string]*StoredFile) error {
+	for _, shard := range s.shards {
+		err := shard.filesForItem(name, byName)
+		if err != nil {
+			return err
+		}
+	}
+	if s.shards != nil {
+		return nil
+	}
+	format, err := columnOrNull(context.Background(), s.db, "main", "files", "f", "format")
+	if err != nil {
+		return err
+	}
+	// files migrated from the old hashes table have no name
+	rows, err := s.db.Query(`SELECT COALESCE(f.name, ''), COALESCE(`+format+`, ''), fh.algo, fh.hash
+FROM archive_items ai
+JOIN files f ON f.item = ai.id
+JOIN file_hashes fh ON fh.file = f.id
+WHERE ai.name = (?);`, name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fileName, format, algo string
+		var hash []byte
+		err = rows.Scan(&fileName, &format, &algo, &hash)
+		if err != nil {
+			return err
+		}
+		f, ok := byName[fileName]
+		if !ok {
+			f = &StoredFile{Name: fileName, Format: format, Hashes: make(map[string][]byte)}
+			byName[fileName] = f
+		}
+		f.Hashes[algo] = hash
+	}
+	return rows.Err()
+}
+
+// Hashes calls fn with every distinct algo hash, in order, as they are read.
+// A sharded database is ordered within each shard, one shard after another.
+func (s *Storage) Hashes(algo string, fn func(hash []byte) error) error {
+	for _, shard := range s.shards {
+		err := shard.Hashes(algo, fn)
+		if err != nil {
+			return err
+		}
+	}
+	if s.shards != nil {
+		return nil
+	}
+	rows, err := s.db.Query(`SELECT DISTINCT hash FROM file_hashes WHERE algo = (?) ORDER BY hash;`, algo)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash []byte
+		err = rows.Scan(&hash)
+		if err != nil {
+			return err
+		}
+		err = fn(hash)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Intersect calls fn with each of hashes, once, that some file has an algo
+// hash of, and returns how many distinct hashes there were and how many were
+// found. The hashes are joined against the index in a temporary table
+// instead of being looked up one by one.
+func (s *Storage) Intersect(algo string, hashes [][]byte, fn func(hash []byte) error) (distinct, found int64, err error) {
+	if s.shards != nil {
+		byShard := make(map[*Storage][][]byte)
+		for _, hash := range hashes {
+			shard := s.shardFor(hash)
+			byShard[shard] = append(byShard[shard], hash)
+		}
+		for _, shard := range s.shards {
+			d, f, err := shard.Intersect(algo, byShard[shard], fn)
+			if err != nil {
+				return distinct, found, err
+			}
+			distinct, found = distinct+d, found+f
+		}
+		return
+	}
+
+	ctx := context.Background()
+	// temporary tables belong to a connection, so hold on to one
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, `CREATE TEMP TABLE intersect_input (hash BLOB PRIMARY KEY);`)
+	if err != nil {
+		return
+	}
+	defer conn.ExecContext(ctx, `DROP TABLE temp.intersect_input;`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	ins, err := tx.Prepare(`INSERT OR IGNORE INTO temp.intersect_input (hash) VALUES (?);`)
+	if err != nil {
+		return
+	}
+	defer ins.Close()
+	for _, hash := range hashes {
+		_, err = ins.Exec(hash)
+		if err != nil {
+			return
+		}
+	}
+	err = tx.QueryRow(`SELECT COUNT(*) FROM temp.intersect_input;`).Scan(&distinct)
+	if err != nil {
+		return
+	}
+
+	rows, err := tx.Query(`SELECT i.hash FROM temp.intersect_input i
+WHERE EXISTS (SELECT 1 FROM file_hashes fh WHERE fh.algo = (?) AND fh.hash = i.hash)
+ORDER BY i.hash;`, algo)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash []byte
+		err = rows.Scan(&hash)
+		if err != nil {
+			return
+		}
+		found++
+		err = fn(hash)
+		if err != nil {
+			return
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+// Duplicates calls fn for every algo hash found in more than minItems items,
+// most widely mirrored first, with the names of the items containing it. Rows
+// are handed to fn as they are read rather than collected. A sharded database
+// is ordered within each shard, one shard after another.
+func (s *Storage) Duplicates(algo string, minItems int, fn func(hash []byte, items []string) error) error {
+	for _, shard := range s.shards {
+		err := shard.Duplicates(algo, minItems, fn)
+		if err != nil {
+			return err
+		}
+	}
+	if s.shards != nil {
+		return nil
+	}
+	rows, err := s.db.Query(`SELECT fh.hash, GROUP_CONCAT(DISTINCT a.name) FROM file_hashes fh
+JOIN files f ON f.id = fh.file
+JOIN archive_items a ON a.id = f.item
+WHERE fh.algo = (?)
+GROUP BY fh.hash HAVING COUNT(DISTINCT f.item) > (?)
+ORDER BY COUNT(DISTINCT f.item) DESC;`, algo, minItems)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash []byte
+		var names string
+		err = rows.Scan(&hash, &names)
+		if err != nil {
+			return err
+		}
+		err = fn(hash, strings.Split(names, ","))
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Merge copies into s every item in the database at srcPath that s doesn't
+// already have, along with its files and hashes. Items already in s are left
+// alone, so merging the same database twice adds nothing the second time.
+// It returns how many items were added.
+func (s *Storage) Merge(srcPath string) (int64, error) {
+	if s.shards != nil {
+		return 0, fmt.Errorf("merging into a sharded database isn't supported")
+	}
+	ctx := context.Background()
+	// attached databases belong to a connection, so hold on to one
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, `ATTACH DATABASE (?) AS src;`, srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.ExecContext(ctx, `DETACH DATABASE src;`)
+
+	var n int
+	err = conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM src.sqlite_master WHERE type = 'table' AND name = 'files';`).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("%s has no files table; open it for writing once (e.g. by crawling) to migrate it", srcPath)
+	}
+	// src may predate some columns
+	format, err := columnOrNull(ctx, conn, "src", "files", "f", "format")
+	if err != nil {
+		return 0, err
+	}
+	fileSource, err := columnOrNull(ctx, conn, "src", "files", "f", "source")
+	if err != nil {
+		return 0, err
+	}
+	source, err := columnOrNull(ctx, conn, "src", "archive_items", "sa", "source_collection")
+	if err != nil {
+		return 0, err
+	}
+	listing, err := columnOrNull(ctx, conn, "src", "archive_items", "sa", "files_json")
+	if err != nil {
+		return 0, err
+	}
+	isCollection, err := columnOrNull(ctx, conn, "src", "archive_items", "sa", "is_collection")
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// new items get ids above the current largest, and their files keep
+	// their ids from src shifted above the current largest file id, which
+	// is how their hashes are matched up with them
+	var lastItem, fileOffset int64
+	err = tx.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM archive_items;`).Scan(&lastItem)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM files;`).Scan(&fileOffset)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`INSERT INTO archive_items (name, indexed_at, source_collection, files_json, is_collection)
+SELECT sa.name, sa.indexed_at, ` + source + `, ` + listing + `, COALESCE(` + isCollection + `, 0) FROM src.archive_items sa WHERE sa.name NOT IN (SELECT name FROM main.archive_items)
+ORDER BY sa.id;`)
+	if err != nil {
+		return 0, err
+	}
+	added, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`INSERT INTO files (id, item, name, format, source)
+SELECT f.id + (?), d.id, f.name, `+format+`, `+fileSource+` FROM src.files f
+JOIN src.archive_items sa ON sa.id = f.item
+JOIN main.archive_items d ON d.name = sa.name
+WHERE d.id > (?);`, fileOffset, lastItem)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`INSERT INTO file_hashes (file, algo, hash)
+SELECT fh.file + (?), fh.algo, fh.hash FROM src.file_hashes fh
+JOIN src.files f ON f.id = fh.file
+JOIN src.archive_items sa ON sa.id = f.item
+JOIN main.archive_items d ON d.name = sa.name
+WHERE d.id > (?);`, fileOffset, lastItem)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.QueryRow(`SELECT COUNT(*) FROM src.sqlite_master WHERE type = 'table' AND name = 'item_collections';`).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO item_collections (item, collection)
+SELECT d.id, sc.collection FROM src.item_collections sc
+JOIN src.archive_items sa ON sa.id = sc.item
+JOIN main.archive_items d ON d.name = sa.name
+WHERE d.id > (?);`, lastItem)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return added, tx.Commit()
+}
+
+// ItemsFoundIn returns the stored items that were found in collection, by
+// name.
+func (s *Storage) ItemsFoundIn(collection string) ([]string, error) {
+	found := make(map[string]bool)
+	dbs := []*sql.DB{s.db}
+	if s.shards != nil {
+		dbs = dbs[:0]
+		for _, shard := range s.shards {
+			dbs = append(dbs, shard.db)
+		}
+	}
+	for _, db := range dbs {
+		column, err := columnOrNull(context.Background(), db, "main", "archive_items", "a", "source_collection")
+		if err != nil {
+			return nil, err
+		}
+		rows, err := db.Query(`SELECT a.name FROM archive_items a WHERE `+column+` = (?);`, collection)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var name string
+			err = rows.Scan(&name)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			found[name] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete removes the item name along with its files and their hashes,
+// reporting whether it was there to remove. The foreign keys don't cascade,
+// so a row can't be deleted before the rows referring to it; deleting an
+// item any other way fails rather than leaving its files behind.
+func (s *Storage) Delete(name string) (bool, error) {
+	if s.shards != nil {
+		found := false
+		for _, shard := range s.shards {
+			ok, err := shard.Delete(name)
+			if err != nil {
+				return found, err
+			}
+			found = found || ok
+		}
+		return found, nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	found, err := deleteItem(tx, name)
+	if err != nil || !found {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// deleteItem is Delete within tx.
+func deleteItem(tx *sql.Tx, name string) (bool, error) {
+	var id int64
+	err := tx.QueryRow(`SELECT id FROM archive_items WHERE name = (?);`, name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`DELETE FROM file_hashes WHERE file IN (SELECT id FROM files WHERE item = (?));`, id)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`DELETE FROM files WHERE item = (?);`, id)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`DELETE FROM item_collections WHERE item = (?);`, id)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`DELETE FROM archive_items WHERE id = (?);`, id)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DuplicatePolicy is what storing an item already stored under the same name
+// does, as happens when overlapping crawls race or a page is redone.
+type DuplicatePolicy int
+
+const (
+	DuplicateError DuplicatePolicy = iota // fail with the constraint's error, unless from the same collection
+	DuplicateSkip                         // leave it be and fail with ErrAlreadyStored
+	DuplicateMerge                        // add the files and hashes it lacks
+)
+
+// skipReason says why the file f of item isn't stored, or returns "" if it
+// is. Derivatives are only stored if derivatives is set.
+func skipReason(item string, f *File, derivatives bool) string {
+	if f.Name == "__ia_thumb.jpg" {
+		return "thumbnail"
+	}
+	// the torrent's own hashes change whenever the item does, so it's only
+	// kept for its info-hash
+	if f.Name == item+"_archive.torrent" {
+		if f.Btih == "" {
+			return "torrent, and its info-hash wasn't fetched"
+		}
+		return ""
+	}
+	switch f.Source {
+	case "metadata":
+		return "archive.org's own metadata"
+	case "derivative":
+		if !derivatives {
+			return "derivative of another file"
+		}
+	}
+	// older listings may not give a source
+	if strings.HasPrefix(f.Name, item) {
+		suffix := f.Name[len(item):]
+		if suffix == "_files.xml" || suffix == "_meta.sqlite" || suffix == "_meta.xml" || suffix == "_reviews.xml" {
+			return "archive.org's own metadata"
+		}
+	}
+	return ""
+}
+
+// skipHashReason is skipReason for a hash of a stored file.
+func skipHashReason(item string, f *File, h fileHash) string {
+	if f.Name == item+"_archive.torrent" && h.algo != "btih" {
+		return "torrent, which is only kept for its info-hash"
+	}
+	return ""
+}
+
+// Explain calls fn for every file of the item and each of the file's hashes,
+// with algo empty for the file itself, giving the reason NewEntry would
+// leave it out, or "" if it would be stored, with derivatives set as
+// IndexDerivatives. It doesn't touch a database.
+func Explain(item string, im *ItemMetadata, derivatives bool, fn func(file, algo, reason string)) {
+	for _, f := range im.Files {
+		reason := skipReason(item, &f, derivatives)
+		fn(f.Name, "", reason)
+		if reason != "" {
+			continue
+		}
+		for _, h := range f.Hashes() {
+			reason := skipHashReason(item, &f, h)
+			if reason == "" {
+				_, err := HashFromHex(h.algo, h.hex)
+				if err != nil {
+					reason = err.Error()
+				}
+			}
+			fn(f.Name, h.algo, reason)
+		}
+	}
+}
+
+// NewEntry stores the files of item and their hashes. collection is where
+// the item was found, and may be empty.
+func (s *Storage) NewEntry(im *ItemMetadata, item, collection string) error {
+	return s.NewEntries([]Entry{{Item: item, Collection: collection, Metadata: im}})[0]
+}
+
+// Entry is an item for NewEntries to store.
+type Entry struct {
+	Item       string
+	Collection string // where the item was found; may be empty
+	Metadata   *ItemMetadata
+	// if set, an item already stored under the same name is replaced,
+	// whatever the storage's OnDuplicate says; it's only removed if the
+	// entry is stored
+	Replace bool
+}
+
+// NewEntries stores each of entries as NewEntry would, returning what went
+// wrong with each, or nil if it was stored. They share a transaction, which
+// is much cheaper than one each, but one that fails doesn't keep the others
+// from being stored.
+func (s *Storage) NewEntries(entries []Entry) []error {
+	errs := make([]error, len(entries))
+	if s.shards != nil {
+		// stored one at a time, each split across the shards
+		for i, e := range entries {
+			errs[i] = errNoFiles
+			if len(e.Metadata.Files) == 0 {
+				continue
+			}
+			if e.Replace {
+				// the shards can't share a transaction, so the
+				// old item goes first
+				_, errs[i] = s.Delete(e.Item)
+				if errs[i] != nil {
+					continue
+				}
+			}
+			errs[i] = s.newEntryShards(e.Metadata, e.Item, e.Collection)
+		}
+		return errs
+	}
+	s.writes <- struct{}{}
+	err := retryBusy(s.opts.BusyRetries, func() error {
+		return s.newEntries(entries, errs)
+	})
+	<-s.writes
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// SetWriteConcurrency lets n calls to NewEntries write at once, where the
+// default is 1. SQLite allows only one writer, so more just contend for its
+// lock, but a database that takes concurrent writes would benefit. It must
+// be called before anything is written.
+func (s *Storage) SetWriteConcurrency(n int) {
+	for _, shard := range s.shards {
+		shard.SetWriteConcurrency(n)
+	}
+	s.writes = make(chan struct{}, max(n, 1))
+}
+
+// newEntries fills in errs for entries, returning an error instead if none of
+// them could be stored.
+func (s *Storage) newEntries(entries []Entry, errs []error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	insName := tx.Stmt(s.insName)
+	insFile := tx.Stmt(s.insFile)
+	insHash := tx.Stmt(s.insHash)
+	insColl := tx.Stmt(s.insColl)
+
+	// an entry replacing an item deletes it under a savepoint, which is
+	// rolled back to if the entry then fails, keeping the old item
+	replacing := -1
+	settle := func() error {
+		if replacing < 0 {
+			return nil
+		}
+		failed := errs[replacing] != nil
+		replacing = -1
+		if failed {
+			_, err := tx.Exec(`ROLLBACK TO replace;`)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`RELEASE replace;`)
+		return err
+	}
+
+	total := 0
+	for i, e := range entries {
+		err = settle()
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		files, err := decodeEntry(e.Metadata, e.Item, s.opts.IndexDerivatives)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		var listing []byte
+		if s.opts.KeepListings && e.Metadata.RawFiles != nil {
+			listing, err = gzipBytes(e.Metadata.RawFiles)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+		if e.Replace {
+			_, err = tx.Exec(`SAVEPOINT replace;`)
+			if err == nil {
+				replacing = i
+				_, err = deleteItem(tx, e.Item)
+			}
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		// this is the entry's first insert, so if it fails, there's
+		// nothing of the entry to undo
+		var id int64
+		err = insName.QueryRow(e.Item, time.Now().Unix(), e.Collection, listing, e.Metadata.IsCollection).Scan(&id)
+		// files and hashes are added to the item already stored, keeping
+		// those it has
+		merging := false
+		if isUnique(err) && s.opts.OnDuplicate == DuplicateSkip {
+			err = ErrAlreadyStored
+		} else if isUnique(err) && s.opts.OnDuplicate == DuplicateMerge {
+			err = tx.QueryRow(`SELECT id FROM archive_items WHERE name = (?);`, e.Item).Scan(&id)
+			merging = true
+		} else if isUnique(err) && e.Collection != "" {
+			// found where it was found before, as when a page is redone
+			// after a crash, rather than by an overlapping crawl
+			var n int
+			qerr := tx.QueryRow(`SELECT COUNT(*) FROM archive_items WHERE name = (?) AND source_collection = (?);`, e.Item, e.Collection).Scan(&n)
+			if qerr != nil {
+				err = qerr
+			} else if n > 0 {
+				err = ErrAlreadyStored
+			}
+		}
+		if isBusy(err) {
+			tx.Rollback()
+			return err
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		inserted := 0
+		for _, f := range files {
+			var fileID int64
+			err = sql.ErrNoRows
+			if merging {
+				err = tx.QueryRow(`SELECT id FROM files WHERE item = (?) AND name = (?) LIMIT 1;`, id, f.name).Scan(&fileID)
+			}
+			if err == sql.ErrNoRows {
+				err = insFile.QueryRow(id, f.name, f.format, f.source).Scan(&fileID)
+			}
+			if isBusy(err) {
+				tx.Rollback()
+				return err
+			}
+			if err != nil {
+				log.Printf("item %s: file %s: %v\n", e.Item, f.name, err)
+				continue
+			}
+			for _, h := range f.hashes {
+				var res sql.Result
+				if merging {
+					res, err = tx.Exec(`INSERT INTO file_hashes (file, algo, hash) VALUES (?, ?, ?) ON CONFLICT DO NOTHING;`, fileID, h.algo, h.hash)
+				} else {
+					res, err = insHash.Exec(fileID, h.algo, h.hash)
+				}
+				if isBusy(err) {
+					tx.Rollback()
+					return err
+				}
+				if err != nil {
+					log.Printf("item %s: file %s: %s: %v\n", e.Item, f.name, h.algo, err)
+					continue
+				}
+				// a hash the file already has adds nothing
+				if n, err := res.RowsAffected(); err == nil && n == 0 {
+					continue
+				}
+				inserted++
+			}
+		}
+		if inserted == 0 && merging {
+			// it had everything already
+			errs[i] = ErrAlreadyStored
+			continue
+		}
+		if inserted == 0 {
+			// every insert failed, which shouldn't happen
+			_, err = tx.Exec(`DELETE FROM files WHERE item = (?);
+DELETE FROM archive_items WHERE id = (?);`, id, id)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			errs[i] = errNoValidFiles
+			continue
+		}
+		for _, c := range e.Metadata.Collections {
+			_, err = insColl.Exec(id, c)
+			if isBusy(err) {
+				tx.Rollback()
+				return err
+			}
+			if err != nil {
+				log.Printf("item %s: collection %s: %v\n", e.Item, c, err)
+			}
+		}
+		errs[i] = nil
+		total += inserted
+	}
+	err = settle()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	DefaultMetrics.HashesInserted.Add(int64(total))
+	return nil
+}
+
+type decodedFile struct {
+	name, format, source string
+	hashes               []decodedHash
+}
+
+type decodedHash struct {
+	algo string
+	hash []byte
+}
+
+// decodeEntry returns the files of item that are stored, with the hashes
+// of each that are, or errNoValidFiles if there are none. derivatives is as
+// for skipReason.
+func decodeEntry(im *ItemMetadata, item string, derivatives bool) ([]decodedFile, error) {
+	if len(im.Files) == 0 {
+		return nil, errNoFiles
+	}
+	var files []decodedFile
+	for _, f := range im.Files {
+		if skipReason(item, &f, derivatives) != "" {
+			continue
+		}
+		var hashes []decodedHash
+		for _, h := range f.Hashes() {
+			if skipHashReason(item, &f, h) != "" {
+				continue
+			}
+			hash, err := HashFromHex(h.algo, h.hex)
+			if err != nil {
+				log.Printf("item %s: file %s: %v\n", item, f.Name, err)
+				continue
+			}
+			hashes = append(hashes, decodedHash{h.algo, hash})
+		}
+		if len(hashes) > 0 {
+			files = append(files, decodedFile{f.Name, f.Format, f.Source, hashes})
+		}
+	}
+	if len(files) == 0 {
+		return nil, errNoValidFiles
+	}
+	return files, nil
+}
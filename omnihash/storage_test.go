@@ -0,0 +1,189 @@
+package omnihash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func newTestStorage(t testing.TB) *Storage {
+	s, err := NewStorage(testDBPath(t), StorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testDBPath(t testing.TB) string {
+	return filepath.Join(t.TempDir(), "hashes.db")
+}
+
+func testItem() *ItemMetadata {
+	return &ItemMetadata{
+		Files:       []File{{Name: "a.txt", Sha1: testSha1, Md5: testMd5}},
+		Collections: []string{"coll"},
+	}
+}
+
+func TestDeleteForeignKeys(t *testing.T) {
+	s := newTestStorage(t)
+	err := s.NewEntry(testItem(), "item0", "coll")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the item's files still refer to it
+	_, err = s.db.Exec(`DELETE FROM archive_items WHERE name = 'item0';`)
+	var serr sqlite3.Error
+	if !errors.As(err, &serr) || serr.ExtendedCode != sqlite3.ErrConstraintForeignKey {
+		t.Fatalf("deleting the item alone: got %v, want a foreign key error", err)
+	}
+
+	found, err := s.Delete("item0")
+	if err != nil || !found {
+		t.Fatalf("Delete: got %v, %v", found, err)
+	}
+	files, err := s.FilesForItem("item0")
+	if err != nil || len(files) != 0 {
+		t.Fatalf("after Delete: got files %v, %v", files, err)
+	}
+	var left int
+	err = s.db.QueryRow(`SELECT (SELECT COUNT(*) FROM files) + (SELECT COUNT(*) FROM file_hashes) + (SELECT COUNT(*) FROM item_collections);`).Scan(&left)
+	if err != nil || left != 0 {
+		t.Errorf("after Delete: %d rows left, %v", left, err)
+	}
+
+	found, err = s.Delete("item0")
+	if err != nil || found {
+		t.Errorf("Delete again: got %v, %v", found, err)
+	}
+}
+
+func TestNewEntryDuplicate(t *testing.T) {
+	s := newTestStorage(t)
+	err := s.NewEntry(testItem(), "item0", "coll")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as when the page it was on is redone
+	err = s.NewEntry(testItem(), "item0", "coll")
+	if !errors.Is(err, ErrAlreadyStored) {
+		t.Errorf("from the same collection: got %v, want ErrAlreadyStored", err)
+	}
+	// as when overlapping crawls race
+	err = s.NewEntry(testItem(), "item0", "other")
+	if !isUnique(err) {
+		t.Errorf("from another collection: got %v, want a unique constraint error", err)
+	}
+}
+
+// lockDB holds the write lock of the database at path from a connection of
+// its own until the returned func is called.
+func lockDB(t *testing.T, path string) func() {
+	db, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.ExecContext(context.Background(), `BEGIN IMMEDIATE;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		conn.ExecContext(context.Background(), `ROLLBACK;`)
+		conn.Close()
+		db.Close()
+	}
+}
+
+func TestNewEntryBusy(t *testing.T) {
+	path := testDBPath(t)
+	s, err := NewStorage(path, StorageOptions{BusyRetries: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// one connection, so the shorter busy timeout applies to every write
+	s.db.SetMaxOpenConns(1)
+	_, err = s.db.Exec(`PRAGMA busy_timeout = 50;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// released after the first attempt has timed out, so only a retry can
+	// store it
+	unlock := lockDB(t, path)
+	time.AfterFunc(300*time.Millisecond, unlock)
+	err = s.NewEntry(testItem(), "item0", "coll")
+	if err != nil {
+		t.Fatalf("with the lock released during the retries: %v", err)
+	}
+	files, err := s.FilesForItem("item0")
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got files %v, %v", files, err)
+	}
+
+	// held past every retry
+	s.opts.BusyRetries = 2
+	unlock = lockDB(t, path)
+	err = s.NewEntry(testItem(), "item1", "coll")
+	unlock()
+	if !isBusy(err) {
+		t.Fatalf("with the lock held throughout: got %v, want a busy error", err)
+	}
+	files, err = s.FilesForItem("item1")
+	if err != nil || len(files) != 0 {
+		t.Fatalf("got files %v, %v for an item that wasn't stored", files, err)
+	}
+}
+
+// benchItem returns the metadata of the nth item of a benchmark, with a few
+// files whose hashes no other item has.
+func benchItem(n int) *ItemMetadata {
+	im := &ItemMetadata{Collections: []string{"coll"}}
+	for i := range 5 {
+		im.Files = append(im.Files, File{
+			Name: fmt.Sprintf("file%d.txt", i),
+			Sha1: fmt.Sprintf("%032x%08x", n, i),
+			Md5:  fmt.Sprintf("%024x%08x", n, i),
+		})
+	}
+	return im
+}
+
+// BenchmarkNewEntries compares storing items one at a time, each in its own
+// transaction, with storing them in batches as the Writer does. The database
+// is a temporary file rather than :memory:, since each pooled connection to
+// :memory: would be a database of its own.
+func BenchmarkNewEntries(b *testing.B) {
+	for _, size := range []int{1, writeBatchSize} {
+		b.Run(fmt.Sprintf("batch %d", size), func(b *testing.B) {
+			s := newTestStorage(b)
+			n := 0
+			b.ResetTimer()
+			for range b.N {
+				entries := make([]Entry, size)
+				for i := range entries {
+					entries[i] = Entry{Item: fmt.Sprintf("item%d", n), Collection: "coll", Metadata: benchItem(n)}
+					n++
+				}
+				for _, err := range s.NewEntries(entries) {
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(n), "ns/item")
+		})
+	}
+}
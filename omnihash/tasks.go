@@ -0,0 +1,677 @@
+package omnihash
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Job struct {
+	Collection string
+	Page       int
+	// where a scrape API crawl of the collection resumes; empty when it is
+	// paged through with advancedsearch
+	Cursor string
+	Depth  int
+	// how many items archive.org reports the collection has, the most seen
+	// so far since it can change while the collection is crawled; 0 if
+	// unknown
+	Total int
+	// how many items were indexed on the pages checkpointed so far, over
+	// every run; items on a page redone after a crash are only counted if
+	// they weren't stored the first time
+	Indexed int64
+}
+
+// Progress returns the fraction of the collection's items on the pages up to
+// and including job.Page, when pages hold pageSize items, or -1 if the total
+// is unknown.
+func (job *Job) Progress(pageSize int) float64 {
+	if job.Total <= 0 {
+		return -1
+	}
+	return min(1, float64(job.Page*pageSize)/float64(job.Total))
+}
+
+// TasksOptions are how a Tasks queue behaves, fixed when it is opened.
+type TasksOptions struct {
+	// how many times to try a write while another connection holds the
+	// database locked; DefaultBusyRetries if 0
+	BusyRetries int
+	// how many levels of sub-collections Add queues below the collections
+	// given by the user; 0 queues none
+	MaxDepth int
+}
+
+// DefaultMaxDepth is the MaxDepth of a crawl not told otherwise.
+const DefaultMaxDepth = 5
+
+type Tasks struct {
+	db         *sql.DB
+	opts       TasksOptions
+	next       *sql.Stmt
+	checkpoint *sql.Stmt
+	add        *sql.Stmt
+	remove     *sql.Stmt
+	remember   *sql.Stmt
+	hasDone    *sql.Stmt
+	count      *sql.Stmt
+	remaining  *sql.Stmt
+	skip       *sql.Stmt
+	fail       *sql.Stmt
+	// every collection queued or finished this run, mapped to how many
+	// levels of sub-collections it is below a collection given by the user;
+	// guarded by mu, since Add may be called from several goroutines
+	mu      sync.Mutex
+	visited map[string]int
+}
+
+func NewTasks(dbPath string, opts TasksOptions) (*Tasks, error) {
+	// yes, this code is ugly. no, I don't know a better way
+
+	if opts.BusyRetries == 0 {
+		opts.BusyRetries = DefaultBusyRetries
+	}
+	t := Tasks{opts: opts, visited: make(map[string]int)}
+	var err error
+
+	t.db, err = openSQLite(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.db.Exec(`CREATE TABLE IF NOT EXISTS jobs (
+name VARCHAR(255) PRIMARY KEY,
+page INTEGER,
+cursor TEXT,
+total INTEGER NOT NULL DEFAULT 0,
+depth INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_page ON jobs(page);
+CREATE TABLE IF NOT EXISTS done (
+name VARCHAR(255) PRIMARY KEY,
+page INTEGER,
+reason TEXT,
+indexed INTEGER NOT NULL DEFAULT 0,
+skipped INTEGER NOT NULL DEFAULT 0,
+failed INTEGER NOT NULL DEFAULT 0,
+finished_at INTEGER
+);
+CREATE TABLE IF NOT EXISTS skipped_items (
+name VARCHAR(255) PRIMARY KEY,
+collection VARCHAR(255),
+reason TEXT,
+skipped_at INTEGER
+);
+CREATE TABLE IF NOT EXISTS failed_items (
+name VARCHAR(255) PRIMARY KEY,
+collection VARCHAR(255),
+error TEXT,
+failed_at INTEGER
+);
+-- where the watch command is in the changes feed; at most one row
+CREATE TABLE IF NOT EXISTS changes_feed (
+id INTEGER PRIMARY KEY CHECK (id = 1),
+token TEXT NOT NULL,
+updated_at INTEGER
+);
+-- items to be fetched by themselves rather than as part of a collection,
+-- such as those the watch command found changed; seq goes up each time one
+-- is queued again
+CREATE TABLE IF NOT EXISTS queued_items (
+name VARCHAR(255) PRIMARY KEY,
+collections TEXT NOT NULL DEFAULT '',
+only_collections INTEGER NOT NULL DEFAULT 0,
+seq INTEGER NOT NULL DEFAULT 0,
+queued_at INTEGER
+)`)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	err = addColumn(t.db, "jobs", "cursor", "TEXT")
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	err = addColumn(t.db, "jobs", "total", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	// jobs queued before it was recorded are taken as roots
+	err = addColumn(t.db, "jobs", "depth", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	err = addColumn(t.db, "jobs", "indexed", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	for _, col := range []string{"indexed", "skipped", "failed"} {
+		err = addColumn(t.db, "done", col, "INTEGER NOT NULL DEFAULT 0")
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	// unix time; NULL for collections finished before it was recorded
+	err = addColumn(t.db, "done", "finished_at", "INTEGER")
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	// what kind of failure it was, as from FailureKind
+	err = addColumn(t.db, "failed_items", "kind", "TEXT")
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	err = addColumn(t.db, "done", "status", "TEXT")
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	// before the status was recorded, only errors had a reason
+	_, err = t.db.Exec(`UPDATE done SET status = CASE WHEN COALESCE(reason, '') = '' THEN 'completed' ELSE 'error' END WHERE status IS NULL;`)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	t.next, err = t.db.Prepare(`SELECT name, page, COALESCE(cursor, ''), total, depth, indexed FROM jobs ORDER BY page ASC LIMIT 1;`)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.checkpoint, err = t.db.Prepare(`UPDATE jobs SET page = (?), cursor = NULLIF((?), ''), total = MAX(total, (?)), indexed = (?) WHERE name = (?);`)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.add, err = t.db.Prepare(`INSERT INTO jobs (name, page, depth) VALUES (?, ?, ?) ON CONFLICT DO NOTHING;`)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.remove, err = t.db.Prepare(`DELETE FROM jobs WHERE name = (?);`)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.remember, err = t.db.Prepare(`INSERT INTO done (name, page, status, reason, indexed, skipped, failed, finished_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.hasDone, err = t.db.Prepare(`SELECT 1 FROM done WHERE name = (?);`)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.count, err = t.db.Prepare(`SELECT COUNT(*) FROM jobs;`)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.remaining, err = t.db.Prepare(`SELECT COALESCE(SUM(MAX(total - (page - 1) * (?), 0)), 0), COALESCE(SUM(total = 0), 0) FROM jobs;`)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.skip, err = t.db.Prepare(`INSERT OR REPLACE INTO skipped_items (name, collection, reason, skipped_at) VALUES (?, ?, ?, ?);`)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.fail, err = t.db.Prepare(`INSERT OR REPLACE INTO failed_items (name, collection, error, kind, failed_at) VALUES (?, ?, ?, ?, ?);`)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// Len counts the queued jobs, including any added by another process since
+// the last call.
+func (t *Tasks) Len() (int, error) {
+	var n int
+	err := t.count.QueryRow().Scan(&n)
+	return n, err
+}
+
+// Remaining counts the items on the pages of queued collections not yet
+// checkpointed, when pages hold pageSize items, and how many of the
+// collections aren't counted because their size isn't known yet.
+func (t *Tasks) Remaining(pageSize int) (items int64, unknown int, err error) {
+	err = t.remaining.QueryRow(pageSize).Scan(&items, &unknown)
+	return items, unknown, err
+}
+
+// Next returns the job with the lowest page, or false if the queue is empty.
+func (t *Tasks) Next() (*Job, bool, error) {
+	var job Job
+	err := t.next.QueryRow().Scan(&job.Collection, &job.Page, &job.Cursor, &job.Total, &job.Depth, &job.Indexed)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	// jobs left over from a previous run were not seen by Add
+	t.mu.Lock()
+	if _, ok := t.visited[job.Collection]; !ok {
+		t.visited[job.Collection] = job.Depth
+	}
+	t.mu.Unlock()
+	return &job, true, nil
+}
+
+// Checkpoint records that every item on job's page has been handled, so the
+// next page is where a resumed crawl starts. It must only be called once the
+// whole page is done: if the process dies before then, the page is fetched
+// and walked again rather than skipped. Redoing a page is harmless: the
+// items stored the first time are already stored from the same collection,
+// which NewEntry rejects with ErrAlreadyStored whatever the duplicate policy,
+// so they count as skipped rather than failed. The page is stored outright rather than incremented, so calling
+// Checkpoint twice for the same page can't skip the one after it. A crawl
+// following a scrape cursor should set job.Cursor to the cursor for the next
+// page before calling Checkpoint, and any crawl should raise job.Total to
+// the collection's size if it has learned it, and add the items indexed on
+// the page to job.Indexed, which is stored with the page in one statement.
+func (t *Tasks) Checkpoint(job *Job) {
+	err := execRetry(t.opts.BusyRetries, t.checkpoint, job.Page+1, job.Cursor, job.Total, job.Indexed, job.Collection)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Add queues the collection name at the given depth, to be crawled from page
+// on, unless it was already queued or finished, which keeps collections that
+// contain each other from being crawled in circles.
+func (t *Tasks) Add(name string, page, depth int) {
+	t.mu.Lock()
+	if _, ok := t.visited[name]; ok {
+		t.mu.Unlock()
+		return
+	}
+	if depth > t.opts.MaxDepth {
+		t.mu.Unlock()
+		log.Printf("not queueing %s: deeper than %d nested collections\n", name, t.opts.MaxDepth)
+		return
+	}
+	t.visited[name] = depth
+	t.mu.Unlock()
+	var done int
+	err := t.hasDone.QueryRow(name).Scan(&done)
+	if err == nil && done == 1 {
+		return
+	}
+	err = execRetry(t.opts.BusyRetries, t.add, name, page, depth)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// ErrAlreadyDone is returned by Enqueue for a collection already finished.
+var ErrAlreadyDone = errors.New("already finished")
+
+// Enqueue queues the collection name as a root to be crawled from page on, as
+// asked for by hand. Unlike Add, it moves a collection already queued to
+// page, dropping its scrape cursor, and reports that it did. A collection
+// already finished is left alone, failing with ErrAlreadyDone, since it has
+// to be requeued to be crawled again.
+func (t *Tasks) Enqueue(name string, page int) (moved bool, err error) {
+	var done int
+	err = t.hasDone.QueryRow(name).Scan(&done)
+	if err == nil {
+		return false, fmt.Errorf("%s: %w", name, ErrAlreadyDone)
+	}
+	if err != sql.ErrNoRows {
+		return false, err
+	}
+	err = retryBusy(t.opts.BusyRetries, func() error {
+		var n int
+		err := t.db.QueryRow(`SELECT COUNT(*) FROM jobs WHERE name = (?);`, name).Scan(&n)
+		if err != nil {
+			return err
+		}
+		moved = n > 0
+		_, err = t.db.Exec(`INSERT INTO jobs (name, page, depth) VALUES (?, ?, 0)
+ON CONFLICT (name) DO UPDATE SET page = excluded.page, cursor = NULL;`, name, page)
+		return err
+	})
+	return moved, err
+}
+
+// Summary counts what happened to the items of a collection during a run.
+type Summary struct {
+	Indexed atomic.Int64
+	Skipped atomic.Int64 // unchanged, filtered out, or a sub-collection queued instead
+	Failed  atomic.Int64
+}
+
+// DoneStatus is how a collection came to be done, as recorded in done.status.
+type DoneStatus string
+
+const (
+	DoneCompleted  DoneStatus = "completed"  // crawled to the end
+	DoneEmpty      DoneStatus = "empty"      // had no items at all
+	DoneError      DoneStatus = "error"      // stopped at a page that couldn't be fetched
+	DoneDenylisted DoneStatus = "denylisted" // never crawled, as asked
+	DoneSampled    DoneStatus = "sampled"    // crawled to the end, fetching only some items
+)
+
+// Remove takes job off the queue and records it as done with status, and
+// reason, which explains an error. sum may be nil.
+func (t *Tasks) Remove(job *Job, status DoneStatus, reason string, sum *Summary) {
+	if sum == nil {
+		sum = &Summary{}
+	}
+	err := execRetry(t.opts.BusyRetries, t.remove, job.Collection)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = execRetry(t.opts.BusyRetries, t.remember, job.Collection, job.Page, string(status), reason, sum.Indexed.Load(), sum.Skipped.Load(), sum.Failed.Load(), time.Now().Unix())
+	if err != nil {
+		log.Printf("failed to remember deletion of %v %v by reason %v: %v\n", job.Collection, job.Page, reason, err)
+	}
+}
+
+// FailureKind sorts an error from fetching an item into one of a few kinds,
+// so failures can be counted or retried by kind.
+func FailureKind(err error) string {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return "not found"
+	case errors.Is(err, ErrItemUnavailable):
+		return "unavailable"
+	case errors.Is(err, ErrItemTimeout):
+		return "timed out"
+	case errors.Is(err, ErrRateLimited):
+		return "rate limited"
+	case errors.Is(err, ErrDecode):
+		return "bad response"
+	case Transient(err):
+		return "transient"
+	}
+	return "other"
+}
+
+// Fail records that the item name in collection couldn't be fetched, and
+// why.
+func (t *Tasks) Fail(name, collection string, cause error) {
+	err := execRetry(t.opts.BusyRetries, t.fail, name, collection, cause.Error(), FailureKind(cause), time.Now().Unix())
+	if err != nil {
+		log.Printf("failed to remember failing %s: %v\n", name, err)
+	}
+}
+
+// FailedItem is an item recorded by Fail.
+type FailedItem struct {
+	Name       string
+	Collection string
+	Error      string
+	Kind       string // as from FailureKind; empty if failed before it was recorded
+}
+
+// FailedItems returns the items recorded by Fail and not yet recovered.
+func (t *Tasks) FailedItems() ([]FailedItem, error) {
+	rows, err := t.db.Query(`SELECT name, COALESCE(collection, ''), COALESCE(error, ''), COALESCE(kind, '') FROM failed_items ORDER BY failed_at;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []FailedItem
+	for rows.Next() {
+		var f FailedItem
+		err = rows.Scan(&f.Name, &f.Collection, &f.Error, &f.Kind)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, f)
+	}
+	return items, rows.Err()
+}
+
+// Recovered forgets that the item name failed, once it has been fetched.
+func (t *Tasks) Recovered(name string) error {
+	_, err := t.db.Exec(`DELETE FROM failed_items WHERE name = (?);`, name)
+	return err
+}
+
+// RequeueFilter selects finished collections for Requeue.
+type RequeueFilter struct {
+	// collections crawled to the end, or that were empty, are only
+	// included if All is set; otherwise just those that stopped with an
+	// error are
+	All bool
+	// also include collections that were only sampled
+	Sampled bool
+	// if set, only collections whose reason contains it
+	Reason string
+	// if not zero, only collections finished in this window
+	After, Before time.Time
+}
+
+// Requeue moves the finished collections matching f back onto the queue,
+// returning how many were moved. A collection that stopped with an error
+// resumes at the page before the one recorded, which is the page that first
+// failed; one crawled to the end starts over. Collections already queued are
+// left as they are.
+func (t *Tasks) Requeue(f RequeueFilter) (int64, error) {
+	var after, before int64
+	if !f.After.IsZero() {
+		after = f.After.Unix()
+	}
+	if !f.Before.IsZero() {
+		before = f.Before.Unix()
+	}
+	where := `WHERE ((?) OR status = 'error' OR ((?) AND status = 'sampled')) AND instr(COALESCE(reason, ''), (?)) > 0
+AND ((?) = 0 OR finished_at >= (?)) AND ((?) = 0 OR finished_at < (?))`
+	args := []any{f.All, f.Sampled, f.Reason, after, after, before, before}
+
+	tx, err := t.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO jobs (name, page)
+SELECT name, CASE WHEN status = 'error' THEN MAX(1, COALESCE(page, 1) - 1) ELSE 1 END FROM done
+`+where+`
+ON CONFLICT DO NOTHING;`, args...)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`DELETE FROM done `+where+`;`, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// Skip records that the item name in collection was deliberately not
+// indexed, and why.
+func (t *Tasks) Skip(name, collection, reason string) {
+	err := execRetry(t.opts.BusyRetries, t.skip, name, collection, reason, time.Now().Unix())
+	if err != nil {
+		log.Printf("failed to remember skipping %s: %v\n", name, err)
+	}
+}
+
+// ChangesToken returns where the changes feed was left off, or "" if it
+// hasn't been read.
+func (t *Tasks) ChangesToken() (string, error) {
+	var token string
+	err := t.db.QueryRow(`SELECT token FROM changes_feed WHERE id = 1;`).Scan(&token)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return token, err
+}
+
+// QueuedItem is an item to be fetched and stored by itself, replacing
+// whatever is stored under its name.
+type QueuedItem struct {
+	Name string
+	// the collections to record it as found in, the first of them it
+	// belongs to being chosen; if it belongs to none, the first it belongs
+	// to at all is
+	Collections []string
+	// if set, it's only stored if it belongs to one of Collections
+	OnlyCollections bool
+	// to tell whether it was queued again since it was read
+	seq int64
+}
+
+// QueueChanges queues items and records token as where to resume the changes
+// feed, in one transaction, so a batch of the feed is either queued along
+// with the token after it or read again. An item already queued is updated
+// rather than queued twice.
+func (t *Tasks) QueueChanges(items []QueuedItem, token string) error {
+	return retryBusy(t.opts.BusyRetries, func() error {
+		tx, err := t.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		now := time.Now().Unix()
+		for _, it := range items {
+			_, err = tx.Exec(`INSERT INTO queued_items (name, collections, only_collections, queued_at) VALUES (?, ?, ?, ?)
+ON CONFLICT (name) DO UPDATE SET collections = excluded.collections, only_collections = MIN(only_collections, excluded.only_collections), seq = seq + 1, queued_at = excluded.queued_at;`,
+				it.Name, strings.Join(it.Collections, " "), it.OnlyCollections, now)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec(`INSERT INTO changes_feed (id, token, updated_at) VALUES (1, ?, ?)
+ON CONFLICT (id) DO UPDATE SET token = excluded.token, updated_at = excluded.updated_at;`, token, now)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// QueuedItems returns up to n of the items queued by QueueChanges, those
+// queued first first.
+func (t *Tasks) QueuedItems(n int) ([]QueuedItem, error) {
+	rows, err := t.db.Query(`SELECT name, collections, only_collections, seq FROM queued_items ORDER BY queued_at, name LIMIT (?);`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []QueuedItem
+	for rows.Next() {
+		var it QueuedItem
+		var collections string
+		err = rows.Scan(&it.Name, &collections, &it.OnlyCollections, &it.seq)
+		if err != nil {
+			return nil, err
+		}
+		it.Collections = strings.Fields(collections)
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// Unqueue takes items returned by QueuedItems off the queue, once they have
+// been handled, except those queued again since.
+func (t *Tasks) Unqueue(items []QueuedItem) error {
+	return retryBusy(t.opts.BusyRetries, func() error {
+		tx, err := t.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, it := range items {
+			_, err = tx.Exec(`DELETE FROM queued_items WHERE name = (?) AND seq = (?);`, it.Name, it.seq)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// Forget takes the collection name off the queue and out of the finished
+// collections, and forgets the items skipped in it or failed, so adding it
+// again crawls it from the start.
+func (t *Tasks) Forget(name string) error {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM jobs WHERE name = (?);`, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM done WHERE name = (?);`, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM skipped_items WHERE collection = (?);`, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM failed_items WHERE collection = (?);`, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	t.mu.Lock()
+	delete(t.visited, name)
+	t.mu.Unlock()
+	return tx.Commit()
+}
+
+func (t *Tasks) Close() {
+	if t.next != nil {
+		t.next.Close()
+	}
+	if t.checkpoint != nil {
+		t.checkpoint.Close()
+	}
+	if t.add != nil {
+		t.add.Close()
+	}
+	if t.remove != nil {
+		t.remove.Close()
+	}
+	if t.remember != nil {
+		t.remember.Close()
+	}
+	if t.hasDone != nil {
+		t.hasDone.Close()
+	}
+	if t.count != nil {
+		t.count.Close()
+	}
+	if t.remaining != nil {
+		t.remaining.Close()
+	}
+	if t.skip != nil {
+		t.skip.Close()
+	}
+	if t.fail != nil {
+		t.fail.Close()
+	}
+	if t.db != nil {
+		t.db.Close()
+	}
+}
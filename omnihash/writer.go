@@ -0,0 +1,173 @@
+package omnihash
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+// how many parsed items may wait to be written before fetching blocks, which
+// keeps memory bounded and paces fetching to how fast items can be stored
+const writeQueueSize = 100
+
+// at most how many waiting items are stored together
+const writeBatchSize = 50
+
+// Sink is where a Writer stores items: a *Storage, or a *JSONLines.
+type Sink interface {
+	NewEntries(entries []Entry) []error
+}
+
+// Writer stores items on its own goroutine so fetching never waits on the
+// database. While it runs, it is the only user of its Sink's insert path,
+// which also keeps SQLite writes serialized.
+type Writer struct {
+	// if set, the Validators of each item stored are saved in it
+	Cache *ValidatorCache
+
+	sink    Sink
+	queue   chan writeRequest
+	stopped chan struct{}
+}
+
+type writeRequest struct {
+	item       string
+	collection string
+	im         *ItemMetadata
+	sum        *Summary
+	// as Entry.Replace
+	replace bool
+	// if set, sent what went wrong storing im, or nil
+	result chan error
+	// if set, closed once everything queued before it has been written
+	synced chan struct{}
+}
+
+func NewWriter(sink Sink) *Writer {
+	w := Writer{
+		sink:    sink,
+		queue:   make(chan writeRequest, writeQueueSize),
+		stopped: make(chan struct{}),
+	}
+	go w.run()
+	return &w
+}
+
+func (w *Writer) run() {
+	var batch []writeRequest
+	for req := range w.queue {
+		batch = append(batch[:0], req)
+		// whatever else is already waiting is stored along with it, up
+		// to a Sync
+	fill:
+		for len(batch) < writeBatchSize && batch[len(batch)-1].synced == nil {
+			select {
+			case req, ok := <-w.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, req)
+			default:
+				break fill
+			}
+		}
+		w.write(batch)
+	}
+	close(w.stopped)
+}
+
+func (w *Writer) write(batch []writeRequest) {
+	entries := make([]Entry, 0, len(batch))
+	for _, req := range batch {
+		if req.synced == nil {
+			entries = append(entries, Entry{Item: req.item, Collection: req.collection, Metadata: req.im, Replace: req.replace})
+		}
+	}
+	var errs []error
+	if len(entries) > 0 {
+		errs = w.sink.NewEntries(entries)
+	}
+	for _, req := range batch {
+		if req.synced != nil {
+			close(req.synced)
+			continue
+		}
+		err := errs[0]
+		errs = errs[1:]
+		if w.Cache != nil && (err == nil || errors.Is(err, ErrAlreadyStored)) {
+			v := req.im.Validators
+			w.Cache.Put(v.URL, v.ETag, v.LastModified)
+		}
+		if req.result != nil {
+			req.result <- err
+		}
+		if errors.Is(err, ErrAlreadyStored) {
+			req.sum.Skipped.Add(1)
+		} else if err != nil {
+			log.Printf("in item %s: %v\n", req.item, err)
+			req.sum.Failed.Add(1)
+			DefaultMetrics.ItemsFailed.Add(1)
+		} else {
+			req.sum.Indexed.Add(1)
+		}
+	}
+}
+
+// Write queues im to be stored under the name item, found in collection,
+// counting the outcome in sum. If the queue is full, it waits for room or
+// until ctx is done, in which case im isn't stored.
+func (w *Writer) Write(ctx context.Context, item, collection string, im *ItemMetadata, sum *Summary) error {
+	select {
+	case w.queue <- writeRequest{item: item, collection: collection, im: im, sum: sum}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Replace is Write, but im replaces whatever is stored under the name item,
+// as with Entry.Replace.
+func (w *Writer) Replace(ctx context.Context, item, collection string, im *ItemMetadata, sum *Summary) error {
+	select {
+	case w.queue <- writeRequest{item: item, collection: collection, im: im, sum: sum, replace: true}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Store is Write, but waits until im has been stored, returning what went
+// wrong storing it. If ctx is done first, im may or may not be stored.
+func (w *Writer) Store(ctx context.Context, item, collection string, im *ItemMetadata, sum *Summary) error {
+	result := make(chan error, 1)
+	select {
+	case w.queue <- writeRequest{item: item, collection: collection, im: im, sum: sum, result: result}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Len returns how many items are waiting to be written.
+func (w *Writer) Len() int {
+	return len(w.queue)
+}
+
+// Sync waits until everything queued so far has been written.
+func (w *Writer) Sync() {
+	synced := make(chan struct{})
+	w.queue <- writeRequest{synced: synced}
+	<-synced
+}
+
+// Close writes whatever is still queued and stops the writer. The Sink is
+// left open.
+func (w *Writer) Close() {
+	close(w.queue)
+	<-w.stopped
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+)
+
+// sampler picks the items of each page a sampled crawl fetches: a fraction
+// of them, or a fixed count, chosen at random but the same way every time for
+// the same seed, collection, and page, so a resumed crawl samples the pages it
+// redoes as before.
+type sampler struct {
+	fraction float64 // of each page, if > 0
+	count    int     // per page, if > 0
+	seed     uint64
+}
+
+func (s *sampler) enabled() bool {
+	return s.fraction > 0 || s.count > 0
+}
+
+// pick returns which of the n items on the page of collection to fetch, or
+// nil if every item is.
+func (s *sampler) pick(collection string, page, n int) []bool {
+	if !s.enabled() {
+		return nil
+	}
+	k := s.count
+	if s.fraction > 0 {
+		// a small page still gets one
+		k = max(1, int(math.Round(s.fraction*float64(n))))
+	}
+	if k >= n {
+		return nil
+	}
+	h := fnv.New64a()
+	h.Write([]byte(collection))
+	r := rand.New(rand.NewPCG(s.seed, h.Sum64()^uint64(page)))
+	picked := make([]bool, n)
+	for _, i := range r.Perm(n)[:k] {
+		picked[i] = true
+	}
+	return picked
+}
+
+// String describes the sample, as recorded for a collection it was taken of.
+func (s *sampler) String() string {
+	if s.fraction > 0 {
+		return fmt.Sprintf("sampled %g%% of each page with seed %d", s.fraction*100, s.seed)
+	}
+	return fmt.Sprintf("sampled %d items of each page with seed %d", s.count, s.seed)
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// there are no signals to spare for pausing a crawl
+var pauseSignal, resumeSignal os.Signal
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathaniel28/acrawl/omnihash"
+)
+
+// how many recent log messages the dashboard shows
+const dashboardLines = 8
+
+// Dashboard redraws a summary of the crawl on a terminal every second. While
+// it runs, log output is shown in it instead of scrolling by.
+type Dashboard struct {
+	out     io.Writer
+	prev    io.Writer // where log output went before the dashboard took it
+	tee     io.Writer
+	mu      sync.Mutex
+	recent  []string
+	started time.Time
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// StartDashboard draws on out. If tee isn't nil, log output is also written
+// to it, such as to keep a log file going.
+func StartDashboard(out, tee io.Writer) *Dashboard {
+	d := Dashboard{
+		out:     out,
+		prev:    log.Writer(),
+		tee:     tee,
+		started: time.Now(),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	log.SetOutput(&d)
+	go d.run()
+	return &d
+}
+
+// Write takes log output, keeping the last few lines to show.
+func (d *Dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.tee != nil {
+		d.tee.Write(p)
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		d.recent = append(d.recent, line)
+	}
+	if len(d.recent) > dashboardLines {
+		d.recent = d.recent[len(d.recent)-dashboardLines:]
+	}
+	return len(p), nil
+}
+
+func (d *Dashboard) run() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	last := omnihash.DefaultMetrics.ItemsProcessed.Load()
+	lastAt := time.Now()
+	for {
+		select {
+		case <-d.stop:
+			close(d.stopped)
+			return
+		case now := <-tick.C:
+			items := omnihash.DefaultMetrics.ItemsProcessed.Load()
+			perSec := float64(items-last) / now.Sub(lastAt).Seconds()
+			last, lastAt = items, now
+			d.draw(items, perSec)
+		}
+	}
+}
+
+func (d *Dashboard) draw(items int64, perSec float64) {
+	var b strings.Builder
+	// move to the top left and clear the screen
+	b.WriteString("\x1b[H\x1b[2J")
+	collection, page, progress := omnihash.DefaultMetrics.Job()
+	fmt.Fprintf(&b, "omnihash, running for %v\n\n", time.Since(d.started).Truncate(time.Second))
+	if progress >= 0 {
+		fmt.Fprintf(&b, "collection:      %s (page %d, %.0f%% done)\n", collection, page, progress*100)
+	} else {
+		fmt.Fprintf(&b, "collection:      %s (page %d)\n", collection, page)
+	}
+	fmt.Fprintf(&b, "queued:          %d collections\n", omnihash.DefaultMetrics.QueueLength.Load())
+	if eta, left := omnihash.DefaultMetrics.ETA(); eta >= 0 {
+		fmt.Fprintf(&b, "time left:       about %v for %d items\n", eta.Round(time.Second), left)
+	}
+	fmt.Fprintf(&b, "items:           %d (%.2f/s)\n", items, perSec)
+	fmt.Fprintf(&b, "hashes stored:   %d\n", omnihash.DefaultMetrics.HashesInserted.Load())
+	if omnihash.DefaultMetrics.Paused.Load() {
+		b.WriteString("request rate:    paused\n")
+	} else if omnihash.DefaultMetrics.Rate != nil {
+		fmt.Fprintf(&b, "request rate:    %.2f/s\n", omnihash.DefaultMetrics.Rate())
+	}
+	fmt.Fprintf(&b, "last minute:     %d requests\n", omnihash.DefaultMetrics.RequestsPerMinute())
+	if omnihash.DefaultMetrics.WriteQueue != nil {
+		fmt.Fprintf(&b, "waiting writes:  %d\n", omnihash.DefaultMetrics.WriteQueue())
+	}
+	b.WriteString("\nrecent messages:\n")
+	d.mu.Lock()
+	for _, line := range d.recent {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	d.mu.Unlock()
+	io.WriteString(d.out, b.String())
+}
+
+// Stop stops redrawing and sends log output back where it went before.
+func (d *Dashboard) Stop() {
+	close(d.stop)
+	<-d.stopped
+	log.SetOutput(d.prev)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/nathaniel28/acrawl/omnihash"
+)
+
+// watchCmd follows archive.org's feed of changed items until interrupted,
+// queueing each stored item that changed, and each new one that might be in
+// the collections given, in the task database. A crawl with the same
+// -tasks-db fetches and stores them before going on with its collections.
+// Where it is in the feed is kept with them, so a restart resumes after the
+// last batch it queued.
+func watchCmd(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	interval := fs.Duration("interval", time.Minute, "once caught up with the feed, how long to wait before asking it for more")
+	startDate := fs.String("start-date", "", "where in the feed to start the first time, as YYYYMMDD; today if empty")
+	changesURL := fs.String("changes-url", omnihash.DefaultChangesURL, "read the feed of changed items from here")
+	maxRate := fs.Float64("max-rate", 2, "never ask the feed for more than this many batches per second")
+	parseFlags(fs, args)
+	if *maxRate <= 0 {
+		log.Fatalf("need -max-rate (%v) > 0\n", *maxRate)
+	}
+	// new items are only queued if they might be in one of these
+	watched := fs.Args()
+
+	// only read, to tell stored items from new ones
+	storage, err := omnihash.NewStorage(hashesDB, omnihash.StorageOptions{})
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	tasks, err := omnihash.NewTasks(tasksDB, omnihash.TasksOptions{})
+	if err != nil {
+		return err
+	}
+	defer tasks.Close()
+
+	// the items themselves are fetched by the crawl, at its own rate
+	client := omnihash.Client{
+		Limiter: omnihash.NewAdaptiveLimiter(min(0.1, *maxRate), *maxRate, 1, 0.2),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	intr := make(chan os.Signal, 1)
+	signal.Notify(intr, os.Interrupt)
+	go func() {
+		<-intr
+		log.Println("interrupted; stopping without finishing the batch, which is read again next time")
+		cancel()
+	}()
+	wait := func(d time.Duration) {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+
+	token, err := tasks.ChangesToken()
+	if err != nil {
+		return err
+	}
+	if token == "" && *startDate == "" {
+		*startDate = time.Now().UTC().Format("20060102")
+	}
+	if token == "" {
+		infof("reading the changes feed from %s\n", *startDate)
+	}
+
+	for ctx.Err() == nil {
+		ch, err := omnihash.NewChanges(ctx, &client, *changesURL, token, *startDate)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			if !omnihash.Transient(err) {
+				return err
+			}
+			log.Printf("reading the changes feed: %v; trying again in %v\n", err, *interval)
+			wait(*interval)
+			continue
+		}
+		ids := ch.Identifiers()
+		var items []omnihash.QueuedItem
+		for _, item := range ids {
+			files, err := storage.FilesForItem(item)
+			if err != nil {
+				return err
+			}
+			// which of its collections is only known once it's fetched
+			switch {
+			case len(files) > 0:
+				items = append(items, omnihash.QueuedItem{Name: item, Collections: watched})
+			case len(watched) > 0:
+				items = append(items, omnihash.QueuedItem{Name: item, Collections: watched, OnlyCollections: true})
+			}
+		}
+		// the token is saved with them, so a batch is queued whole or not
+		// at all
+		token = ch.NextToken
+		err = tasks.QueueChanges(items, token)
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			infof("%d items changed, %d of them queued; about %d changes behind\n", len(ids), len(items), ch.Distance)
+		}
+		if ch.Sleep || len(ids) == 0 {
+			wait(*interval)
+		}
+	}
+	return nil
+}